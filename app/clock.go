@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock supplies the current time, in unix seconds, that user ages are
+// computed against.
+type Clock interface {
+	Now() int
+}
+
+// datasetClock is the moment the live dataset was generated, from
+// options.txt. It follows the dataset across reloads.
+type datasetClock struct{}
+
+func (datasetClock) Now() int {
+	return currentStore().date
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() int {
+	return int(time.Now().Unix())
+}
+
+// overridableClock reads base unless a test has pinned the time through
+// the admin endpoint.
+type overridableClock struct {
+	base       Clock
+	override   int64
+	overridden int32
+}
+
+func (c *overridableClock) Now() int {
+	if atomic.LoadInt32(&c.overridden) != 0 {
+		return int(atomic.LoadInt64(&c.override))
+	}
+	return c.base.Now()
+}
+
+func (c *overridableClock) Set(now int) {
+	atomic.StoreInt64(&c.override, int64(now))
+	atomic.StoreInt32(&c.overridden, 1)
+}
+
+func (c *overridableClock) Reset() {
+	atomic.StoreInt32(&c.overridden, 0)
+}
+
+var clock = &overridableClock{base: wallClock{}}
+
+// ageBound returns the instant b such that someone born at birth is at
+// least age full years old at now exactly when birth < b. Ages are counted
+// by calendar date in UTC: a birthday counts from the start of its day and
+// people born on February 29 age on March 1 in common years. Filters compare
+// birth dates against the bound, so nothing is computed per visit.
+func ageBound(now, age int) int {
+	n := time.Unix(int64(now), 0).UTC()
+	day := time.Date(n.Year()-age, n.Month(), n.Day(), 0, 0, 0, 0, time.UTC)
+	if day.Day() != n.Day() {
+		// February 29 in a common year: everyone born up to the end of
+		// February has had their birthday
+		return int(time.Date(n.Year()-age, n.Month()+1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	}
+	return int(day.AddDate(0, 0, 1).Unix())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func unixUTC(t *testing.T, s string) int {
+	t.Helper()
+	at, err := time.Parse("2006-01-02 15:04:05", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(at.Unix())
+}
+
+func TestAgeBound(t *testing.T) {
+	tests := []struct {
+		birth, now string
+		age        int
+		atLeast    bool
+	}{
+		{"1990-06-15 12:00:00", "2020-06-14 23:59:59", 30, false},
+		{"1990-06-15 12:00:00", "2020-06-15 00:00:00", 30, true},
+		{"1990-06-15 12:00:00", "2020-06-15 00:00:00", 31, false},
+		{"1990-06-15 23:59:59", "2020-06-15 00:00:00", 30, true},
+		{"1999-12-31 23:59:59", "2009-12-31 00:00:00", 10, true},
+		{"2000-01-01 00:00:00", "2009-12-31 23:59:59", 10, false},
+		{"1950-01-01 00:00:00", "2000-01-01 00:00:00", 50, true},
+		{"1950-01-01 00:00:00", "1999-12-31 23:59:59", 50, false},
+		{"2017-08-01 00:00:00", "2017-08-01 00:00:00", 0, true},
+		// born on February 29
+		{"2000-02-29 10:00:00", "2021-02-28 23:59:59", 21, false},
+		{"2000-02-29 10:00:00", "2021-03-01 00:00:00", 21, true},
+		{"2000-02-29 10:00:00", "2024-02-28 23:59:59", 24, false},
+		{"2000-02-29 10:00:00", "2024-02-29 00:00:00", 24, true},
+		// on February 29, against a common birth year
+		{"2003-02-28 23:59:59", "2024-02-29 00:00:00", 21, true},
+		{"2003-03-01 00:00:00", "2024-02-29 23:59:59", 21, false},
+		{"2000-02-28 23:59:59", "2021-02-28 00:00:00", 21, true},
+		{"2000-03-01 00:00:00", "2021-02-28 23:59:59", 21, false},
+	}
+	for _, test := range tests {
+		birth, now := unixUTC(t, test.birth), unixUTC(t, test.now)
+		if got := birth < ageBound(now, test.age); got != test.atLeast {
+			t.Errorf("born %s, at %s: at least %d is %v, want %v", test.birth, test.now, test.age, got, test.atLeast)
+		}
+	}
+}
+
+// calendarAge counts full years between two dates the slow way, with a
+// February 29 birthday falling on March 1 in common years.
+func calendarAge(birth, now time.Time) int {
+	month, day := birth.Month(), birth.Day()
+	if month == time.February && day == 29 && time.Date(now.Year(), 2, 29, 0, 0, 0, 0, time.UTC).Day() != 29 {
+		month, day = time.March, 1
+	}
+	age := now.Year() - birth.Year()
+	if now.Month() < month || now.Month() == month && now.Day() < day {
+		age--
+	}
+	return age
+}
+
+func TestAgeBoundMatchesCalendar(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		now := 946684800 + rnd.Intn(1<<30)
+		birth := now - rnd.Intn(100*366*86400)
+		age := calendarAge(time.Unix(int64(birth), 0).UTC(), time.Unix(int64(now), 0).UTC())
+		for _, bound := range []int{age - 1, age, age + 1} {
+			if bound < 0 {
+				continue
+			}
+			if got := birth < ageBound(now, bound); got != (age >= bound) {
+				t.Fatalf("born %d, at %d, aged %d: at least %d is %v", birth, now, age, bound, got)
+			}
+		}
+	}
+}
+
+// TestAvgAgesPinnedClock pins the clock through the admin endpoints and
+// checks the age filters of Avg move with it across birthdays.
+func TestAvgAgesPinnedClock(t *testing.T) {
+	s := NewStore(0, 0, 0)
+	live.Store(s)
+	users := []struct {
+		birth string
+		mark  int
+	}{
+		{"1990-06-15 12:00:00", 1},
+		{"2000-02-29 10:00:00", 3},
+		{"1980-01-01 00:00:00", 5},
+	}
+	mustCreate(t, s, 'l', `{"id":1,"place":"P","country":"C","city":"T","distance":1}`)
+	for i, user := range users {
+		mustCreate(t, s, 'u', fmt.Sprintf(`{"id":%d,"email":"u%d@x.ru","first_name":"F","last_name":"L","gender":"m","birth_date":%d}`, i+1, i+1, unixUTC(t, user.birth)))
+		mustCreate(t, s, 'v', fmt.Sprintf(`{"id":%d,"location":1,"user":%d,"visited_at":0,"mark":%d}`, i+1, i+1, user.mark))
+	}
+
+	*adminEnabled = true
+	r := newRouter()
+	*adminEnabled = false
+	defer clock.Reset()
+
+	tests := []struct {
+		now   string
+		query string
+		avg   float64
+	}{
+		{"2020-06-14 12:00:00", "fromAge=30", 5},
+		{"2020-06-15 00:00:00", "fromAge=30", 3},
+		{"2020-06-15 00:00:00", "fromAge=30&toAge=40", 1},
+		{"2021-02-28 12:00:00", "toAge=21", 3},
+		{"2021-03-01 00:00:00", "toAge=21", 0},
+		{"2024-02-29 00:00:00", "fromAge=24&toAge=25", 3},
+	}
+	for _, test := range tests {
+		now := unixUTC(t, test.now)
+		ctx := serve(r, "POST", "/admin/clock?now="+strconv.Itoa(now), "")
+		if status, body := ctx.Response.StatusCode(), string(ctx.Response.Body()); status != 200 || body != fmt.Sprintf(`{"now":%d}`, now) {
+			t.Fatalf("pinning %s: %d %s", test.now, status, body)
+		}
+		if got := getAvg(t, 1, test.query); got != test.avg {
+			t.Errorf("at %s, %s: avg %v, want %v", test.now, test.query, got, test.avg)
+		}
+	}
+
+	if ctx := serve(r, "GET", "/admin/clock", ""); string(ctx.Response.Body()) != fmt.Sprintf(`{"now":%d}`, unixUTC(t, "2024-02-29 00:00:00")) {
+		t.Errorf("GET /admin/clock: %s", ctx.Response.Body())
+	}
+	ctx := serve(r, "DELETE", "/admin/clock", "")
+	var now int64
+	fmt.Sscanf(string(ctx.Response.Body()), `{"now":%d}`, &now)
+	if wall := time.Now().Unix(); now < wall-5 || now > wall {
+		t.Errorf("DELETE /admin/clock: %s, want the wall clock near %d", ctx.Response.Body(), wall)
+	}
+	if ctx := serve(r, "POST", "/admin/clock?now=soon", ""); ctx.Response.StatusCode() != 400 {
+		t.Errorf("POST /admin/clock?now=soon: %d, want 400", ctx.Response.StatusCode())
+	}
+	if ctx := serve(newRouter(), "POST", "/admin/clock?now=1", ""); ctx.Response.StatusCode() != 404 {
+		t.Errorf("without -admin, POST /admin/clock: %d, want 404", ctx.Response.StatusCode())
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CSV columns carry the JSON field names, in the order the JSON encoders
+// write them. Readers match columns by header name, so files with the
+// columns shuffled load too.
+var (
+	userColumns     = []string{"id", "birth_date", "email", "first_name", "last_name", "gender"}
+	locationColumns = []string{"id", "distance", "place", "country", "city"}
+	visitColumns    = []string{"id", "location", "user", "visited_at", "mark"}
+)
+
+func csvColumns(entity byte) []string {
+	switch entity {
+	case 'u':
+		return userColumns
+	case 'l':
+		return locationColumns
+	}
+	return visitColumns
+}
+
+func (user *User) csvRecord() []string {
+	return []string{strconv.Itoa(user.ID), strconv.Itoa(user.BirthDate), user.Email, user.FirstName, user.LastName, user.Gender}
+}
+
+func (location *Location) csvRecord() []string {
+	return []string{strconv.Itoa(location.ID), strconv.Itoa(location.Distance), location.Place, location.Country, location.City}
+}
+
+func (visit *Visit) csvRecord() []string {
+	return []string{strconv.Itoa(visit.ID), strconv.Itoa(visit.Location), strconv.Itoa(visit.User), strconv.Itoa(visit.VisitedAt), strconv.Itoa(visit.Mark)}
+}
+
+// csvRow reads named columns out of one record, keeping the first error.
+type csvRow struct {
+	index  map[string]int
+	record []string
+	err    error
+}
+
+func (r *csvRow) string(column string) string {
+	return r.record[r.index[column]]
+}
+
+func (r *csvRow) int(column string) int {
+	v, err := strconv.Atoi(strings.TrimSpace(r.string(column)))
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return v
+}
+
+func (r *csvRow) user() *User {
+	return &User{
+		ID:        r.int("id"),
+		BirthDate: r.int("birth_date"),
+		Email:     r.string("email"),
+		FirstName: r.string("first_name"),
+		LastName:  r.string("last_name"),
+		Gender:    r.string("gender"),
+	}
+}
+
+func (r *csvRow) location() *Location {
+	return &Location{
+		ID:       r.int("id"),
+		Distance: r.int("distance"),
+		Place:    r.string("place"),
+		Country:  r.string("country"),
+		City:     r.string("city"),
+	}
+}
+
+func (r *csvRow) visit() *Visit {
+	return &Visit{
+		ID:        r.int("id"),
+		Location:  r.int("location"),
+		User:      r.int("user"),
+		VisitedAt: r.int("visited_at"),
+		Mark:      r.int("mark"),
+	}
+}
+
+// csvEntity tells which entity a header row describes: the one whose
+// columns it names, each exactly once. It returns 0 for anything else.
+func csvEntity(header []string) (byte, map[string]int) {
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		index[strings.TrimSpace(column)] = i
+	}
+	for _, entity := range []byte{'u', 'l', 'v'} {
+		columns := csvColumns(entity)
+		if len(columns) != len(header) || len(index) != len(header) {
+			continue
+		}
+		matched := true
+		for _, column := range columns {
+			if _, ok := index[column]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return entity, index
+		}
+	}
+	return 0, nil
+}
+
+// parseCSV decodes a CSV data file, the entity given by its header row.
+// Rows that cannot be read are reported and skipped; the rest still need
+// validating.
+func parseCSV(name string, data []byte, report *loadReport) ([]*User, []*Location, []*Visit) {
+	var users []*User
+	var locations []*Location
+	var visits []*Visit
+	r := csv.NewReader(bytes.NewReader(data))
+	header, err := r.Read()
+	if err != nil {
+		report.add(name, 0, malformedCSV(err))
+		return nil, nil, nil
+	}
+	entity, index := csvEntity(header)
+	if entity == 0 {
+		report.add(name, 0, errUnknownFile)
+		return nil, nil, nil
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			report.add(name, 0, malformedCSV(err))
+			continue
+		} else if err != nil {
+			report.add(name, 0, malformedCSV(err))
+			break
+		}
+		row := &csvRow{index: index, record: record}
+		switch entity {
+		case 'u':
+			if user := row.user(); row.err == nil {
+				users = append(users, user)
+			}
+		case 'l':
+			if location := row.location(); row.err == nil {
+				locations = append(locations, location)
+			}
+		case 'v':
+			if visit := row.visit(); row.err == nil {
+				visits = append(visits, visit)
+			}
+		}
+		if row.err != nil {
+			line, column := r.FieldPos(0)
+			report.add(name, 0, malformedCSV(&csv.ParseError{StartLine: line, Line: line, Column: column, Err: row.err}))
+		}
+	}
+	return users, locations, visits
+}
+
+func malformedCSV(err error) *Error {
+	return &Error{Code: "malformed_csv", Message: err.Error()}
+}
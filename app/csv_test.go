@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+// TestCSVRecordRoundTrip writes one entity of each kind the way Export
+// does and expects parseFile to read back the same fields.
+func TestCSVRecordRoundTrip(t *testing.T) {
+	user := &User{ID: 7, BirthDate: -300, Email: "q\"uote@x.ru", FirstName: "Анна, \"Ann\"", LastName: "O'Neil\nJr", Gender: "f"}
+	location := &Location{ID: 3, Distance: 0, Place: "Pier 7, \"south\"", Country: "Côte d'Ivoire", City: " San Pedro "}
+	visit := &Visit{ID: 9, Location: 3, User: 7, VisitedAt: -5, Mark: 5}
+	render := func(entity byte, record []string) dataFile {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write(csvColumns(entity))
+		w.Write(record)
+		w.Flush()
+		return memoryFile(string(entity)+".csv", buf.Bytes())
+	}
+
+	parsed := parseFile(render('u', user.csvRecord()))
+	if len(parsed.issues.issues) > 0 || len(parsed.users) != 1 || userFields(parsed.users[0]) != userFields(user) {
+		t.Errorf("user: got %+v with %v, want %+v", parsed.users, parsed.issues.issues, user)
+	}
+	parsed = parseFile(render('l', location.csvRecord()))
+	if len(parsed.issues.issues) > 0 || len(parsed.locations) != 1 || locationFields(parsed.locations[0]) != locationFields(location) {
+		t.Errorf("location: got %+v with %v, want %+v", parsed.locations, parsed.issues.issues, location)
+	}
+	parsed = parseFile(render('v', visit.csvRecord()))
+	if len(parsed.issues.issues) > 0 || len(parsed.visits) != 1 || visitFields(parsed.visits[0]) != visitFields(visit) {
+		t.Errorf("visit: got %+v with %v, want %+v", parsed.visits, parsed.issues.issues, visit)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	tests := []struct {
+		name, data string
+		// the IDs read, whatever their kind, and the codes reported
+		ids    []int
+		issues []string
+	}{
+		{
+			name: "shuffled columns",
+			data: "gender,last_name,id,email,birth_date,first_name\nm,L,4,a@x.ru,-5,F\nf,M,5,b@x.ru,6,G\n",
+			ids:  []int{4, 5},
+		},
+		{
+			name: "padded integers",
+			data: "id,location,user,visited_at,mark\n 1 ,2,3, 40,5\n",
+			ids:  []int{1},
+		},
+		{
+			name:   "unknown header",
+			data:   "id,name\n1,x\n",
+			issues: []string{errUnknownFile.Code},
+		},
+		{
+			name:   "a column twice",
+			data:   "id,distance,place,country,country\n1,2,P,C,T\n",
+			issues: []string{errUnknownFile.Code},
+		},
+		{
+			name:   "empty file",
+			issues: []string{"malformed_csv"},
+		},
+		{
+			name:   "short row",
+			data:   "id,distance,place,country,city\n1,2,P,C\n2,3,P,C,T\n",
+			ids:    []int{2},
+			issues: []string{"malformed_csv"},
+		},
+		{
+			name:   "long row",
+			data:   "id,distance,place,country,city\n1,2,P,C,T\n2,3,P,C,T,X\n",
+			ids:    []int{1},
+			issues: []string{"malformed_csv"},
+		},
+		{
+			name:   "non-integer fields",
+			data:   "id,location,user,visited_at,mark\n1,2,3,4,5\nx,2,3,4,5\n3,2,3,4.5,5\n4,2,3,4,5\n",
+			ids:    []int{1, 4},
+			issues: []string{"malformed_csv", "malformed_csv"},
+		},
+	}
+	for _, test := range tests {
+		parsed := parseFile(memoryFile("data.csv", []byte(test.data)))
+		var ids []int
+		for _, user := range parsed.users {
+			ids = append(ids, user.ID)
+		}
+		for _, location := range parsed.locations {
+			ids = append(ids, location.ID)
+		}
+		for _, visit := range parsed.visits {
+			ids = append(ids, visit.ID)
+		}
+		if !equalInts(ids, test.ids) {
+			t.Errorf("%s: read %v, want %v", test.name, ids, test.ids)
+		}
+		var codes []string
+		for _, issue := range parsed.issues.issues {
+			codes = append(codes, issue.code)
+		}
+		if len(codes) != len(test.issues) {
+			t.Errorf("%s: reported %v, want %v", test.name, parsed.issues.issues, test.issues)
+			continue
+		}
+		for i := range codes {
+			if codes[i] != test.issues[i] {
+				t.Errorf("%s: reported %v, want %v", test.name, parsed.issues.issues, test.issues)
+			}
+		}
+	}
+	// the shuffled header still maps every column to its field
+	parsed := parseFile(memoryFile("users.csv", []byte(tests[0].data)))
+	want := &User{ID: 4, BirthDate: -5, Email: "a@x.ru", FirstName: "F", LastName: "L", Gender: "m"}
+	if len(parsed.users) == 0 || userFields(parsed.users[0]) != userFields(want) {
+		t.Errorf("shuffled columns: got %+v, want %+v", parsed.users, want)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
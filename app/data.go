@@ -2,18 +2,29 @@ package main
 
 type User struct {
 	ID, BirthDate                      int
-	Age                                int `json:"-,"`
 	Email, FirstName, LastName, Gender string
 
-	visits []*Visit `json:"-,"`
+	visits visitList `json:"-,"`
 }
 
 func (user *User) IsValid() bool {
-	return user.ID > 0 && len(user.Email) > 0 && len(user.FirstName) > 0 && len(user.LastName) > 0 && len(user.Gender) > 0
+	return user.Validate() == nil
 }
 
-func (user *User) CalculateAge() {
-	user.Age = (currentDate - user.BirthDate) / 31557600
+func (user *User) Validate() *Error {
+	switch {
+	case !validID(user.ID):
+		return errIDOutOfRange
+	case len(user.Email) == 0:
+		return missingField("email")
+	case len(user.FirstName) == 0:
+		return missingField("first_name")
+	case len(user.LastName) == 0:
+		return missingField("last_name")
+	case len(user.Gender) == 0:
+		return missingField("gender")
+	}
+	return nil
 }
 
 func readUser(data []byte) (*User, error) {
@@ -25,11 +36,25 @@ type Location struct {
 	ID, Distance         int
 	Place, Country, City string
 
-	visits []*Visit `json:"-,"`
+	visits locationVisits `json:"-,"`
 }
 
 func (location *Location) IsValid() bool {
-	return location.ID > 0 && len(location.Place) > 0 && len(location.Country) > 0 && len(location.City) > 0
+	return location.Validate() == nil
+}
+
+func (location *Location) Validate() *Error {
+	switch {
+	case !validID(location.ID):
+		return errIDOutOfRange
+	case len(location.Place) == 0:
+		return missingField("place")
+	case len(location.Country) == 0:
+		return missingField("country")
+	case len(location.City) == 0:
+		return missingField("city")
+	}
+	return nil
 }
 
 func readLocation(data []byte) (*Location, error) {
@@ -45,7 +70,19 @@ type Visit struct {
 }
 
 func (visit *Visit) IsValid() bool {
-	return visit.ID > 0
+	return visit.Validate() == nil
+}
+
+func (visit *Visit) Validate() *Error {
+	switch {
+	case !validID(visit.ID):
+		return errIDOutOfRange
+	case !validID(visit.Location):
+		return outOfRange("location")
+	case !validID(visit.User):
+		return outOfRange("user")
+	}
+	return nil
 }
 
 func readVisit(data []byte) (*Visit, error) {
@@ -55,6 +92,7 @@ func readVisit(data []byte) (*Visit, error) {
 
 type VisitsResult struct {
 	Visits []VisitResult
+	Next   string `json:"next,omitempty"`
 }
 
 type VisitResult struct {
@@ -28,13 +28,8 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp(in *jlexer.Lexer, out *
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "visits":
 			if in.IsNull() {
@@ -53,12 +48,22 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp(in *jlexer.Lexer, out *
 				}
 				for !in.IsDelim(']') {
 					var v1 VisitResult
-					(v1).UnmarshalEasyJSON(in)
+					if in.IsNull() {
+						in.Skip()
+					} else {
+						(v1).UnmarshalEasyJSON(in)
+					}
 					out.Visits = append(out.Visits, v1)
 					in.WantComma()
 				}
 				in.Delim(']')
 			}
+		case "next":
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Next = string(in.String())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -73,22 +78,26 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp(out *jwriter.Writer, in
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"visits\":")
-	if in.Visits == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
-		out.RawString("null")
-	} else {
-		out.RawByte('[')
-		for v2, v3 := range in.Visits {
-			if v2 > 0 {
-				out.RawByte(',')
+	{
+		const prefix string = ",\"visits\":"
+		out.RawString(prefix[1:])
+		if in.Visits == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v2, v3 := range in.Visits {
+				if v2 > 0 {
+					out.RawByte(',')
+				}
+				(v3).MarshalEasyJSON(out)
 			}
-			(v3).MarshalEasyJSON(out)
+			out.RawByte(']')
 		}
-		out.RawByte(']')
+	}
+	if in.Next != "" {
+		const prefix string = ",\"next\":"
+		out.RawString(prefix)
+		out.String(string(in.Next))
 	}
 	out.RawByte('}')
 }
@@ -127,13 +136,8 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp1(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "visits":
 			if in.IsNull() {
@@ -159,7 +163,11 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp1(in *jlexer.Lexer, out
 						if v4 == nil {
 							v4 = new(Visit)
 						}
-						(*v4).UnmarshalEasyJSON(in)
+						if in.IsNull() {
+							in.Skip()
+						} else {
+							(*v4).UnmarshalEasyJSON(in)
+						}
 					}
 					out.Visits = append(out.Visits, v4)
 					in.WantComma()
@@ -180,26 +188,25 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp1(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"visits\":")
-	if in.Visits == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
-		out.RawString("null")
-	} else {
-		out.RawByte('[')
-		for v5, v6 := range in.Visits {
-			if v5 > 0 {
-				out.RawByte(',')
-			}
-			if v6 == nil {
-				out.RawString("null")
-			} else {
-				(*v6).MarshalEasyJSON(out)
+	{
+		const prefix string = ",\"visits\":"
+		out.RawString(prefix[1:])
+		if in.Visits == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v5, v6 := range in.Visits {
+				if v5 > 0 {
+					out.RawByte(',')
+				}
+				if v6 == nil {
+					out.RawString("null")
+				} else {
+					(*v6).MarshalEasyJSON(out)
+				}
 			}
+			out.RawByte(']')
 		}
-		out.RawByte(']')
 	}
 	out.RawByte('}')
 }
@@ -238,20 +245,27 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp2(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "mark":
-			out.Mark = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Mark = int(in.Int())
+			}
 		case "visited_at":
-			out.VisitedAt = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.VisitedAt = int(in.Int())
+			}
 		case "place":
-			out.Place = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Place = string(in.String())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -266,24 +280,21 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp2(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"mark\":")
-	out.Int(int(in.Mark))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"visited_at\":")
-	out.Int(int(in.VisitedAt))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"place\":")
-	out.String(string(in.Place))
+	{
+		const prefix string = ",\"mark\":"
+		out.RawString(prefix[1:])
+		out.Int(int(in.Mark))
+	}
+	{
+		const prefix string = ",\"visited_at\":"
+		out.RawString(prefix)
+		out.Int(int(in.VisitedAt))
+	}
+	{
+		const prefix string = ",\"place\":"
+		out.RawString(prefix)
+		out.String(string(in.Place))
+	}
 	out.RawByte('}')
 }
 
@@ -321,24 +332,39 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp3(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "id":
-			out.ID = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.ID = int(in.Int())
+			}
 		case "location":
-			out.Location = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Location = int(in.Int())
+			}
 		case "user":
-			out.User = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.User = int(in.Int())
+			}
 		case "visited_at":
-			out.VisitedAt = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.VisitedAt = int(in.Int())
+			}
 		case "mark":
-			out.Mark = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Mark = int(in.Int())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -353,36 +379,31 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp3(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"id\":")
-	out.Int(int(in.ID))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"location\":")
-	out.Int(int(in.Location))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"user\":")
-	out.Int(int(in.User))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"visited_at\":")
-	out.Int(int(in.VisitedAt))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"mark\":")
-	out.Int(int(in.Mark))
+	{
+		const prefix string = ",\"id\":"
+		out.RawString(prefix[1:])
+		out.Int(int(in.ID))
+	}
+	{
+		const prefix string = ",\"location\":"
+		out.RawString(prefix)
+		out.Int(int(in.Location))
+	}
+	{
+		const prefix string = ",\"user\":"
+		out.RawString(prefix)
+		out.Int(int(in.User))
+	}
+	{
+		const prefix string = ",\"visited_at\":"
+		out.RawString(prefix)
+		out.Int(int(in.VisitedAt))
+	}
+	{
+		const prefix string = ",\"mark\":"
+		out.RawString(prefix)
+		out.Int(int(in.Mark))
+	}
 	out.RawByte('}')
 }
 
@@ -420,13 +441,8 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp4(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "users":
 			if in.IsNull() {
@@ -452,7 +468,11 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp4(in *jlexer.Lexer, out
 						if v7 == nil {
 							v7 = new(User)
 						}
-						(*v7).UnmarshalEasyJSON(in)
+						if in.IsNull() {
+							in.Skip()
+						} else {
+							(*v7).UnmarshalEasyJSON(in)
+						}
 					}
 					out.Users = append(out.Users, v7)
 					in.WantComma()
@@ -473,26 +493,25 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp4(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"users\":")
-	if in.Users == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
-		out.RawString("null")
-	} else {
-		out.RawByte('[')
-		for v8, v9 := range in.Users {
-			if v8 > 0 {
-				out.RawByte(',')
-			}
-			if v9 == nil {
-				out.RawString("null")
-			} else {
-				(*v9).MarshalEasyJSON(out)
+	{
+		const prefix string = ",\"users\":"
+		out.RawString(prefix[1:])
+		if in.Users == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v8, v9 := range in.Users {
+				if v8 > 0 {
+					out.RawByte(',')
+				}
+				if v9 == nil {
+					out.RawString("null")
+				} else {
+					(*v9).MarshalEasyJSON(out)
+				}
 			}
+			out.RawByte(']')
 		}
-		out.RawByte(']')
 	}
 	out.RawByte('}')
 }
@@ -531,26 +550,45 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp5(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "id":
-			out.ID = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.ID = int(in.Int())
+			}
 		case "birth_date":
-			out.BirthDate = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.BirthDate = int(in.Int())
+			}
 		case "email":
-			out.Email = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Email = string(in.String())
+			}
 		case "first_name":
-			out.FirstName = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.FirstName = string(in.String())
+			}
 		case "last_name":
-			out.LastName = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.LastName = string(in.String())
+			}
 		case "gender":
-			out.Gender = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Gender = string(in.String())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -565,42 +603,36 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp5(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"id\":")
-	out.Int(int(in.ID))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"birth_date\":")
-	out.Int(int(in.BirthDate))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"email\":")
-	out.String(string(in.Email))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"first_name\":")
-	out.String(string(in.FirstName))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"last_name\":")
-	out.String(string(in.LastName))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"gender\":")
-	out.String(string(in.Gender))
+	{
+		const prefix string = ",\"id\":"
+		out.RawString(prefix[1:])
+		out.Int(int(in.ID))
+	}
+	{
+		const prefix string = ",\"birth_date\":"
+		out.RawString(prefix)
+		out.Int(int(in.BirthDate))
+	}
+	{
+		const prefix string = ",\"email\":"
+		out.RawString(prefix)
+		out.String(string(in.Email))
+	}
+	{
+		const prefix string = ",\"first_name\":"
+		out.RawString(prefix)
+		out.String(string(in.FirstName))
+	}
+	{
+		const prefix string = ",\"last_name\":"
+		out.RawString(prefix)
+		out.String(string(in.LastName))
+	}
+	{
+		const prefix string = ",\"gender\":"
+		out.RawString(prefix)
+		out.String(string(in.Gender))
+	}
 	out.RawByte('}')
 }
 
@@ -638,13 +670,8 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp6(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "locations":
 			if in.IsNull() {
@@ -670,7 +697,11 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp6(in *jlexer.Lexer, out
 						if v10 == nil {
 							v10 = new(Location)
 						}
-						(*v10).UnmarshalEasyJSON(in)
+						if in.IsNull() {
+							in.Skip()
+						} else {
+							(*v10).UnmarshalEasyJSON(in)
+						}
 					}
 					out.Locations = append(out.Locations, v10)
 					in.WantComma()
@@ -691,26 +722,25 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp6(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"locations\":")
-	if in.Locations == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
-		out.RawString("null")
-	} else {
-		out.RawByte('[')
-		for v11, v12 := range in.Locations {
-			if v11 > 0 {
-				out.RawByte(',')
-			}
-			if v12 == nil {
-				out.RawString("null")
-			} else {
-				(*v12).MarshalEasyJSON(out)
+	{
+		const prefix string = ",\"locations\":"
+		out.RawString(prefix[1:])
+		if in.Locations == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v11, v12 := range in.Locations {
+				if v11 > 0 {
+					out.RawByte(',')
+				}
+				if v12 == nil {
+					out.RawString("null")
+				} else {
+					(*v12).MarshalEasyJSON(out)
+				}
 			}
+			out.RawByte(']')
 		}
-		out.RawByte(']')
 	}
 	out.RawByte('}')
 }
@@ -749,24 +779,39 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp7(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "id":
-			out.ID = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.ID = int(in.Int())
+			}
 		case "distance":
-			out.Distance = int(in.Int())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Distance = int(in.Int())
+			}
 		case "place":
-			out.Place = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Place = string(in.String())
+			}
 		case "country":
-			out.Country = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Country = string(in.String())
+			}
 		case "city":
-			out.City = string(in.String())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.City = string(in.String())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -781,36 +826,31 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp7(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"id\":")
-	out.Int(int(in.ID))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"distance\":")
-	out.Int(int(in.Distance))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"place\":")
-	out.String(string(in.Place))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"country\":")
-	out.String(string(in.Country))
-	if !first {
-		out.RawByte(',')
-	}
-	first = false
-	out.RawString("\"city\":")
-	out.String(string(in.City))
+	{
+		const prefix string = ",\"id\":"
+		out.RawString(prefix[1:])
+		out.Int(int(in.ID))
+	}
+	{
+		const prefix string = ",\"distance\":"
+		out.RawString(prefix)
+		out.Int(int(in.Distance))
+	}
+	{
+		const prefix string = ",\"place\":"
+		out.RawString(prefix)
+		out.String(string(in.Place))
+	}
+	{
+		const prefix string = ",\"country\":"
+		out.RawString(prefix)
+		out.String(string(in.Country))
+	}
+	{
+		const prefix string = ",\"city\":"
+		out.RawString(prefix)
+		out.String(string(in.City))
+	}
 	out.RawByte('}')
 }
 
@@ -848,16 +888,15 @@ func easyjson794297d0DecodeGithubComSeralexeevHlcupGoApp8(in *jlexer.Lexer, out
 	}
 	in.Delim('{')
 	for !in.IsDelim('}') {
-		key := in.UnsafeString()
+		key := in.UnsafeFieldName(false)
 		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
 		switch key {
 		case "avg":
-			out.Avg = float64(in.Float64())
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				out.Avg = float64(in.Float64())
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -872,12 +911,11 @@ func easyjson794297d0EncodeGithubComSeralexeevHlcupGoApp8(out *jwriter.Writer, i
 	out.RawByte('{')
 	first := true
 	_ = first
-	if !first {
-		out.RawByte(',')
+	{
+		const prefix string = ",\"avg\":"
+		out.RawString(prefix[1:])
+		out.Float64(float64(in.Avg))
 	}
-	first = false
-	out.RawString("\"avg\":")
-	out.Float64(float64(in.Avg))
 	out.RawByte('}')
 }
 
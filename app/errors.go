@@ -0,0 +1,84 @@
+package main
+
+import (
+	jwriter "github.com/mailru/easyjson/jwriter"
+	"github.com/valyala/fasthttp"
+)
+
+// Error is a failure reported to the client. Code is a stable,
+// machine-readable identifier, Field names the offending query argument or
+// body key when there is one. Errors on the hot paths are package-level
+// values so successful requests never allocate for them.
+type Error struct {
+	Status  int
+	Code    string
+	Field   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return e.Code + " (" + e.Field + "): " + e.Message
+	}
+	return e.Code + ": " + e.Message
+}
+
+// MarshalJSON renders the error as {"code":...,"field":...,"message":...},
+// leaving out field when it is empty.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	w.RawString(`{"code":`)
+	w.String(e.Code)
+	if e.Field != "" {
+		w.RawString(`,"field":`)
+		w.String(e.Field)
+	}
+	w.RawString(`,"message":`)
+	w.String(e.Message)
+	w.RawByte('}')
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+var (
+	errRouteNotFound    = &Error{fasthttp.StatusNotFound, "route_not_found", "", "no such endpoint"}
+	errMethodNotAllowed = &Error{fasthttp.StatusMethodNotAllowed, "method_not_allowed", "", "method not allowed for this endpoint"}
+	errNotFound         = &Error{fasthttp.StatusNotFound, "not_found", "id", "no entity with this id"}
+	errBadID            = &Error{fasthttp.StatusNotFound, "invalid_id", "id", "id must be an integer"}
+	errInvalidID        = &Error{fasthttp.StatusBadRequest, "invalid_id", "id", "id must be an integer"}
+	errMalformedJSON    = &Error{fasthttp.StatusBadRequest, "malformed_json", "", "request body is not a valid JSON object"}
+	errDuplicateID      = &Error{fasthttp.StatusBadRequest, "duplicate_id", "id", "an entity with this id already exists"}
+	errIDImmutable      = &Error{fasthttp.StatusBadRequest, "immutable_field", "id", "id cannot be changed"}
+	errIDOutOfRange     = &Error{fasthttp.StatusBadRequest, "out_of_range", "id", "id must be between 1 and 2147483647"}
+	errUnknownGender    = &Error{fasthttp.StatusBadRequest, "unknown_gender", "gender", "gender must be \"f\" or \"m\""}
+	errHasVisits        = &Error{fasthttp.StatusConflict, "has_visits", "", "entity still has visits"}
+	errInvalidLimit     = &Error{fasthttp.StatusBadRequest, "invalid_argument", "limit", "limit must be a positive integer"}
+	errInvalidOrder     = &Error{fasthttp.StatusBadRequest, "invalid_argument", "order", "order must be \"asc\" or \"desc\""}
+	errInvalidCursor    = &Error{fasthttp.StatusBadRequest, "invalid_argument", "cursor", "cursor is not one returned by this endpoint"}
+	errNotPersisted     = &Error{fasthttp.StatusInternalServerError, "not_persisted", "", "change could not be written to the log and was not applied"}
+)
+
+func invalidArgument(field string) *Error {
+	return &Error{fasthttp.StatusBadRequest, "invalid_argument", field, field + " must be a non-negative integer"}
+}
+
+func missingField(field string) *Error {
+	return &Error{fasthttp.StatusBadRequest, "missing_field", field, field + " is required"}
+}
+
+func nullField(field string) *Error {
+	return &Error{fasthttp.StatusBadRequest, "null_field", field, field + " cannot be null"}
+}
+
+func unknownReference(field string) *Error {
+	return &Error{fasthttp.StatusBadRequest, "unknown_reference", field, "referenced " + field + " does not exist"}
+}
+
+func outOfRange(field string) *Error {
+	return &Error{fasthttp.StatusBadRequest, "out_of_range", field, field + " must be between 1 and 2147483647"}
+}
+
+// fail sets the error's status on ctx and returns its body.
+func fail(ctx *fasthttp.RequestCtx, err *Error) []byte {
+	ctx.SetStatusCode(err.Status)
+	return encode(ctx, err)
+}
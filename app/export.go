@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+
+	"github.com/mailru/easyjson"
+	jwriter "github.com/mailru/easyjson/jwriter"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	exportJSON   = "json"
+	exportNDJSON = "ndjson"
+	exportCSV    = "csv"
+)
+
+var errUnknownFormat = &Error{fasthttp.StatusBadRequest, "unknown_format", "format", "format must be \"json\", \"ndjson\" or \"csv\""}
+
+var exportKeys = map[byte]string{'u': "users", 'l': "locations", 'v': "visits"}
+
+// Export streams every entity of one kind. The default format is the
+// {"users":[...]} shape of the data files, so a dump can be loaded back as
+// is; ?format=ndjson writes one object per line with the "type" field
+// /import expects, and ?format=csv a header row and then one row per entity
+// in the columns the loader reads. The store is read a page at a time under
+// the read lock, so the export never holds the whole collection nor blocks
+// writers for long, and a change made while it runs may or may not be
+// included.
+func Export(ctx *fasthttp.RequestCtx, entity byte) []byte {
+	format := string(ctx.QueryArgs().Peek("format"))
+	switch format {
+	case "", exportJSON:
+		format = exportJSON
+		ctx.SetContentTypeBytes(contentTypeBytes)
+	case exportNDJSON:
+		ctx.SetContentType("application/x-ndjson")
+	case exportCSV:
+		ctx.SetContentType("text/csv")
+	default:
+		return fail(ctx, errUnknownFormat)
+	}
+	s := currentStore()
+	ctx.SetBodyStreamWriter(func(out *bufio.Writer) {
+		e := newExporter(format, entity)
+		e.begin()
+		for p := 0; e.page(s, p); p++ {
+			e.flush(out)
+			out.Flush()
+		}
+		e.end()
+		e.flush(out)
+	})
+	return nil
+}
+
+// exporter renders one page of records at a time into w, or for CSV into
+// buf through csv, for the caller to flush once the lock is released.
+type exporter struct {
+	format string
+	entity byte
+	w      jwriter.Writer
+	buf    bytes.Buffer
+	csv    *csv.Writer
+	n      int
+}
+
+func newExporter(format string, entity byte) *exporter {
+	e := &exporter{format: format, entity: entity}
+	if format == exportCSV {
+		e.csv = csv.NewWriter(&e.buf)
+	}
+	return e
+}
+
+func (e *exporter) begin() {
+	switch e.format {
+	case exportJSON:
+		e.w.RawString(`{"` + exportKeys[e.entity] + `":[`)
+	case exportCSV:
+		e.csv.Write(csvColumns(e.entity))
+	}
+}
+
+func (e *exporter) flush(out io.Writer) {
+	if e.csv != nil {
+		e.csv.Flush()
+		e.buf.WriteTo(out)
+		return
+	}
+	e.w.DumpTo(out)
+}
+
+func (e *exporter) end() {
+	if e.format == exportJSON {
+		e.w.RawString(`]}`)
+	}
+}
+
+// page renders page p of the store into e.w and reports whether it exists.
+func (e *exporter) page(s *Store, p int) bool {
+	s.RLock()
+	defer s.RUnlock()
+	switch e.entity {
+	case 'u':
+		return s.UserPage(p, func(user *User) {
+			if e.csv != nil {
+				e.csv.Write(user.csvRecord())
+			} else {
+				e.record(user)
+			}
+		})
+	case 'l':
+		return s.LocationPage(p, func(location *Location) {
+			if e.csv != nil {
+				e.csv.Write(location.csvRecord())
+			} else {
+				e.record(location)
+			}
+		})
+	case 'v':
+		return s.VisitPage(p, func(visit *Visit) {
+			if e.csv != nil {
+				e.csv.Write(visit.csvRecord())
+			} else {
+				e.record(visit)
+			}
+		})
+	}
+	return false
+}
+
+func (e *exporter) record(v easyjson.Marshaler) {
+	if e.format == exportNDJSON {
+		// the type goes first, in front of the record's own fields
+		var record jwriter.Writer
+		v.MarshalEasyJSON(&record)
+		data := record.Buffer.BuildBytes()
+		e.w.RawString(`{"type":"` + entityTypes[e.entity] + `",`)
+		e.w.Raw(data[1:], nil)
+		e.w.RawByte('\n')
+		return
+	}
+	if e.n > 0 {
+		e.w.RawByte(',')
+	}
+	e.n++
+	v.MarshalEasyJSON(&e.w)
+}
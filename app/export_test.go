@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newExportStore is a live store spanning more than one page of visits,
+// with strings that need quoting or escaping in every format.
+func newExportStore(t *testing.T) *Store {
+	s := newTestStore(t, 40, 12, pageSize+100)
+	mustCreate(t, s, 'u', `{"id":41,"email":"q\"uote@x.ru","first_name":"Анна, \"Ann\"","last_name":"O'Neil\nJr","gender":"f","birth_date":-100}`)
+	mustCreate(t, s, 'l', `{"id":13,"place":"Pier 7, \"south\"","country":"Côte d'Ivoire","city":"San\tPedro","distance":0}`)
+	mustCreate(t, s, 'v', `{"id":5000,"location":13,"user":41,"visited_at":-5,"mark":0}`)
+	return s
+}
+
+// exportAll fetches every kind of entity from /export in format and returns
+// the bodies in the order users, locations, visits.
+func exportAll(t *testing.T, format, contentType string) [][]byte {
+	t.Helper()
+	r := newRouter()
+	var bodies [][]byte
+	for _, kind := range []string{"users", "locations", "visits"} {
+		ctx := serve(r, "GET", "/export/"+kind+"?format="+format, "")
+		if status := ctx.Response.StatusCode(); status != fasthttp.StatusOK {
+			t.Fatalf("%s as %q: status %d", kind, format, status)
+		}
+		if !ctx.Response.IsBodyStream() {
+			t.Errorf("%s as %q: the body is not streamed", kind, format)
+		}
+		if got := string(ctx.Response.Header.ContentType()); got != contentType {
+			t.Errorf("%s as %q: content type %q, want %q", kind, format, got, contentType)
+		}
+		bodies = append(bodies, append([]byte(nil), ctx.Response.Body()...))
+	}
+	return bodies
+}
+
+// writeDataset writes bodies as a data directory, each file named after its
+// kind with the extension ext, and returns the directory.
+func writeDataset(t *testing.T, bodies [][]byte, ext string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for i, kind := range []string{"users", "locations", "visits"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, kind+ext), bodies[i], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "options.txt"), []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// loadDataset loads dir into a fresh store, failing on any issue.
+func loadDataset(t *testing.T, dir string) *Store {
+	t.Helper()
+	s := NewStore(0, 0, 0)
+	report, err := loadData(s, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.issues) > 0 {
+		t.Fatalf("loading the export reported %v", report.issues)
+	}
+	return s
+}
+
+func TestExportJSON(t *testing.T) {
+	s := newExportStore(t)
+	for _, format := range []string{"", exportJSON} {
+		bodies := exportAll(t, format, string(contentTypeBytes))
+		checkSameStore(t, loadDataset(t, writeDataset(t, bodies, ".json")), s)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	s := newExportStore(t)
+	bodies := exportAll(t, exportCSV, "text/csv")
+	checkSameStore(t, loadDataset(t, writeDataset(t, bodies, ".csv")), s)
+}
+
+func TestExportNDJSON(t *testing.T) {
+	s := newExportStore(t)
+	bodies := exportAll(t, exportNDJSON, "application/x-ndjson")
+
+	// visits go first, so the batch refers ahead to its users and locations
+	imported := NewStore(0, 0, 0)
+	live.Store(imported)
+	status, response := postImport(t, "", string(bytes.Join([][]byte{bodies[2], bodies[0], bodies[1]}, nil)))
+	if status != fasthttp.StatusOK || !response.Applied {
+		t.Fatalf("import of the export: status %d, applied %v, error %v", status, response.Applied, response.Error)
+	}
+	if len(response.Lines) != s.userCount+s.locationCount+s.visitCount {
+		t.Errorf("%d lines imported, want one per entity", len(response.Lines))
+	}
+	checkSameStore(t, imported, s)
+}
+
+func TestExportUnknownFormat(t *testing.T) {
+	newTestStore(t, 1, 1, 1)
+	ctx := serve(newRouter(), "GET", "/export/users?format=xml", "")
+	if status := ctx.Response.StatusCode(); status != fasthttp.StatusBadRequest {
+		t.Errorf("status %d, want %d", status, fasthttp.StatusBadRequest)
+	}
+	if ctx.Response.IsBodyStream() || !bytes.Contains(ctx.Response.Body(), []byte(errUnknownFormat.Code)) {
+		t.Errorf("body %s, want the %s error", ctx.Response.Body(), errUnknownFormat.Code)
+	}
+}
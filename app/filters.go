@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+type visitPredicate func(*Visit) bool
+
+// visitFilter is the query string of a visit-scanning endpoint. Date bounds
+// are kept apart so callers can turn them into a slice of an ordered visit
+// list; everything else becomes a predicate checked visit by visit. Bounds
+// are strict: fromX keeps values greater than X and toX values less than it.
+// The first invalid argument is kept in err and stops further parsing.
+type visitFilter struct {
+	args *fasthttp.Args
+	err  *Error
+
+	fromDate, toDate       int
+	hasFromDate, hasToDate bool
+
+	predicates []visitPredicate
+}
+
+func newVisitFilter(args *fasthttp.Args) *visitFilter {
+	f := &visitFilter{args: args, predicates: make([]visitPredicate, 0)}
+	f.fromDate, f.hasFromDate = f.uint("fromDate")
+	f.toDate, f.hasToDate = f.uint("toDate")
+	return f
+}
+
+// uint reads a non-negative integer argument, reporting whether it was
+// given.
+func (f *visitFilter) uint(name string) (int, bool) {
+	if f.err != nil {
+		return 0, false
+	}
+	v, err := f.args.GetUint(name)
+	if err == nil {
+		return v, true
+	}
+	if err != fasthttp.ErrNoArgValue {
+		f.err = invalidArgument(name)
+	}
+	return 0, false
+}
+
+// string reads a text argument; an empty value counts as not given.
+func (f *visitFilter) string(name string) (string, bool) {
+	if f.err != nil {
+		return "", false
+	}
+	v := f.args.Peek(name)
+	return string(v), len(v) > 0
+}
+
+func (f *visitFilter) add(p visitPredicate) {
+	f.predicates = append(f.predicates, p)
+}
+
+// locations adds the filters on a visit's location: country, city, place,
+// placePrefix, locationId, fromDistance and toDistance.
+func (f *visitFilter) locations() {
+	if country, ok := f.string("country"); ok {
+		f.add(func(x *Visit) bool {
+			return x.locationRef.Country == country
+		})
+	}
+	if city, ok := f.string("city"); ok {
+		f.add(func(x *Visit) bool {
+			return x.locationRef.City == city
+		})
+	}
+	if place, ok := f.string("place"); ok {
+		f.add(func(x *Visit) bool {
+			return x.locationRef.Place == place
+		})
+	}
+	if prefix, ok := f.string("placePrefix"); ok {
+		f.add(func(x *Visit) bool {
+			return strings.HasPrefix(x.locationRef.Place, prefix)
+		})
+	}
+	if locationID, ok := f.uint("locationId"); ok {
+		f.add(func(x *Visit) bool {
+			return x.Location == locationID
+		})
+	}
+	if fromDistance, ok := f.uint("fromDistance"); ok {
+		f.add(func(x *Visit) bool {
+			return x.locationRef.Distance > fromDistance
+		})
+	}
+	if toDistance, ok := f.uint("toDistance"); ok {
+		f.add(func(x *Visit) bool {
+			return x.locationRef.Distance < toDistance
+		})
+	}
+}
+
+// marks adds fromMark and toMark.
+func (f *visitFilter) marks() {
+	if fromMark, ok := f.uint("fromMark"); ok {
+		f.add(func(x *Visit) bool {
+			return x.Mark > fromMark
+		})
+	}
+	if toMark, ok := f.uint("toMark"); ok {
+		f.add(func(x *Visit) bool {
+			return x.Mark < toMark
+		})
+	}
+}
+
+// ages adds fromAge and toAge, with ages taken at now.
+func (f *visitFilter) ages(now int) {
+	if fromAge, ok := f.uint("fromAge"); ok {
+		bound := ageBound(now, fromAge)
+		f.add(func(x *Visit) bool {
+			return x.userRef.BirthDate < bound
+		})
+	}
+	if toAge, ok := f.uint("toAge"); ok {
+		bound := ageBound(now, toAge)
+		f.add(func(x *Visit) bool {
+			return x.userRef.BirthDate >= bound
+		})
+	}
+}
+
+// span returns the part of an ordered list inside the date bounds.
+func (f *visitFilter) span(l *visitList) (int, int) {
+	lo, hi := 0, len(l.items)
+	if f.hasFromDate {
+		lo = l.after(f.fromDate)
+	}
+	if f.hasToDate {
+		hi = l.before(f.toDate)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi
+}
+
+func (f *visitFilter) match(visit *Visit) bool {
+	for _, p := range f.predicates {
+		if !p(visit) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	jlexer "github.com/mailru/easyjson/jlexer"
+	jwriter "github.com/mailru/easyjson/jwriter"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	errUnknownType    = &Error{fasthttp.StatusBadRequest, "unknown_type", "type", "type must be \"user\", \"location\" or \"visit\""}
+	errImportRejected = &Error{fasthttp.StatusBadRequest, "import_rejected", "", "some lines were rejected, so none were applied"}
+)
+
+var entityTypes = map[byte]string{'u': "user", 'l': "location", 'v': "visit"}
+
+// importLine is the outcome of one line of an import batch.
+type importLine struct {
+	line   int
+	record *newEntity
+	err    *Error
+}
+
+// Import adds newline-delimited users, locations and visits, each object
+// naming its kind in a "type" field. Lines are held to the same rules as
+// Create, with references and duplicates checked against the store and the
+// rest of the batch. The batch is applied only if every line passes and it
+// could be logged, and the response lists the outcome line by line either
+// way.
+func Import(ctx *fasthttp.RequestCtx) []byte {
+	lines, err := importEntities(currentStore(), ctx.PostBody(), ctx.QueryArgs().GetBool("upsert"))
+	if err != nil {
+		ctx.SetStatusCode(err.Status)
+	}
+	return importResult(lines, err)
+}
+
+// importEntities adds the batch in body to s, all of it or none. The batch
+// is logged as one WAL record before any of it is applied, so a restart
+// replays it as a whole too. It returns the outcome of each line and, when
+// nothing was applied, why.
+func importEntities(s *Store, body []byte, upsert bool) ([]importLine, *Error) {
+	lines := make([]importLine, 0)
+	ok := true
+	for i, line := range bytes.Split(body, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		result := importLine{line: i + 1}
+		entity, err := lineType(line)
+		if err == nil {
+			result.record, err = decodeEntity(entity, line)
+		}
+		result.err = err
+		ok = ok && err == nil
+		lines = append(lines, result)
+	}
+	if !ok {
+		return lines, errImportRejected
+	}
+	if len(lines) == 0 {
+		return lines, nil
+	}
+
+	s = s.lockLive()
+	defer s.Unlock()
+	if !checkImport(s, lines, upsert) {
+		return lines, errImportRejected
+	}
+	if err := logImport(body, upsert); err != nil {
+		return lines, err
+	}
+	applyImport(s, lines, upsert)
+	return lines, nil
+}
+
+// lineType reads the "type" field of an import line.
+func lineType(line []byte) (byte, *Error) {
+	in := jlexer.Lexer{Data: line}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if key == "type" {
+			if in.IsNull() {
+				return 0, nullField("type")
+			}
+			switch in.String() {
+			case "user":
+				return 'u', nil
+			case "location":
+				return 'l', nil
+			case "visit":
+				return 'v', nil
+			}
+			if !in.Ok() {
+				return 0, errMalformedJSON
+			}
+			return 0, errUnknownType
+		}
+		in.SkipRecursive()
+		in.WantComma()
+	}
+	if !in.Ok() {
+		return 0, errMalformedJSON
+	}
+	return 0, missingField("type")
+}
+
+// checkImport runs the store-dependent checks of prepareCreate over a whole
+// batch, so that applying it afterwards cannot fail half way. s must be
+// write locked.
+func checkImport(s *Store, lines []importLine, upsert bool) bool {
+	batch := map[byte]map[int]bool{'u': {}, 'l': {}, 'v': {}}
+	ok := true
+	for i := range lines {
+		record := lines[i].record
+		id := record.id()
+		if batch[record.entity][id] {
+			lines[i].err = errDuplicateID
+		}
+		batch[record.entity][id] = true
+		if !upsert && lines[i].err == nil {
+			switch record.entity {
+			case 'u':
+				if s.User(id) != nil {
+					lines[i].err = errDuplicateID
+				}
+			case 'l':
+				if s.Location(id) != nil {
+					lines[i].err = errDuplicateID
+				}
+			case 'v':
+				if s.Visit(id) != nil {
+					lines[i].err = errDuplicateID
+				}
+			}
+		}
+		ok = ok && lines[i].err == nil
+	}
+	for i := range lines {
+		visit := lines[i].record.visit
+		if visit == nil || lines[i].err != nil {
+			continue
+		}
+		if s.Location(visit.Location) == nil && !batch['l'][visit.Location] {
+			lines[i].err = unknownReference("location")
+		} else if s.User(visit.User) == nil && !batch['u'][visit.User] {
+			lines[i].err = unknownReference("user")
+		}
+		ok = ok && lines[i].err == nil
+	}
+	return ok
+}
+
+// logImport appends a checked batch to the WAL as one record, its entity
+// byte saying whether existing IDs are replaced.
+func logImport(body []byte, upsert bool) *Error {
+	if upsert {
+		return logMutation(opImport, opUpsert, 0, body)
+	}
+	return logMutation(opImport, opCreate, 0, body)
+}
+
+// applyImport applies a checked and logged batch to s, which must be write
+// locked. Users and locations go in before the visits that may reference
+// them from earlier lines.
+func applyImport(s *Store, lines []importLine, upsert bool) {
+	for _, entity := range []byte{'u', 'l', 'v'} {
+		for i := range lines {
+			if lines[i].record.entity != entity {
+				continue
+			}
+			// checkImport has vouched for the batch as a whole and it is
+			// in the log already, so there is no backing out of it
+			apply, err := prepareCreate(s, lines[i].record, upsert)
+			if err != nil {
+				log.Panicf("import: line %d passed the batch checks but %v", lines[i].line, err)
+			}
+			apply()
+		}
+	}
+}
+
+// importResult renders {"applied":...,"error":...,"lines":[{"line","type",
+// "id"} or {"line","error"}, ...]}, with the top-level error, the reason
+// nothing was applied, left out when the batch went in.
+func importResult(lines []importLine, err *Error) []byte {
+	w := jwriter.Writer{}
+	w.RawString(`{"applied":`)
+	w.Bool(err == nil)
+	if err != nil {
+		w.RawString(`,"error":`)
+		body, _ := err.MarshalJSON()
+		w.Raw(body, nil)
+	}
+	w.RawString(`,"lines":[`)
+	for i, line := range lines {
+		if i > 0 {
+			w.RawByte(',')
+		}
+		w.RawString(`{"line":`)
+		w.Int(line.line)
+		if line.record != nil {
+			w.RawString(`,"type":`)
+			w.String(entityTypes[line.record.entity])
+			w.RawString(`,"id":`)
+			w.Int(line.record.id())
+		}
+		if line.err != nil {
+			w.RawString(`,"error":`)
+			body, _ := line.err.MarshalJSON()
+			w.Raw(body, nil)
+		}
+		w.RawByte('}')
+	}
+	w.RawString(`]}`)
+	return w.Buffer.BuildBytes()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// importResponse is what /import answers, decoded for comparison.
+type importResponse struct {
+	Applied bool
+	Error   *struct{ Code string }
+	Lines   []struct {
+		Line  int
+		Type  string
+		ID    int
+		Error *struct{ Code, Field string }
+	}
+}
+
+// postImport sends lines to /import and decodes the answer.
+func postImport(t *testing.T, query string, lines ...string) (int, importResponse) {
+	t.Helper()
+	ctx := serve(newRouter(), "POST", "/import"+query, strings.Join(lines, "\n"))
+	var response importResponse
+	if err := json.Unmarshal(ctx.Response.Body(), &response); err != nil {
+		t.Fatalf("%v in %s", err, ctx.Response.Body())
+	}
+	return ctx.Response.StatusCode(), response
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		lines  []string
+		status int
+		// the error code of each line, "" where the line passed
+		errors []string
+	}{
+		{
+			name:   "visit before the user it refers to",
+			lines:  []string{`{"type":"visit","id":5,"location":1,"user":4,"visited_at":10,"mark":3}`, `{"type":"user","id":4,"email":"n@x.ru","first_name":"N","last_name":"U","gender":"f","birth_date":0}`},
+			status: fasthttp.StatusOK,
+			errors: []string{"", ""},
+		},
+		{
+			name:   "duplicate id in the batch",
+			lines:  []string{`{"type":"user","id":4,"email":"a@x.ru","first_name":"A","last_name":"B","gender":"m","birth_date":0}`, `{"type":"user","id":4,"email":"c@x.ru","first_name":"C","last_name":"D","gender":"f","birth_date":0}`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"", "duplicate_id"},
+		},
+		{
+			name:   "duplicate id in the batch with upsert",
+			query:  "?upsert=1",
+			lines:  []string{`{"type":"location","id":1,"place":"A","country":"B","city":"C","distance":1}`, `{"type":"location","id":1,"place":"D","country":"E","city":"F","distance":2}`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"", "duplicate_id"},
+		},
+		{
+			name:   "duplicate id against the store",
+			lines:  []string{`{"type":"location","id":3,"place":"A","country":"B","city":"C","distance":1}`, `{"type":"user","id":2,"email":"a@x.ru","first_name":"A","last_name":"B","gender":"m","birth_date":0}`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"", "duplicate_id"},
+		},
+		{
+			name:   "existing id with upsert",
+			query:  "?upsert=1",
+			lines:  []string{`{"type":"user","id":2,"email":"up@x.ru","first_name":"U","last_name":"P","gender":"f","birth_date":5}`, `{"type":"visit","id":1,"location":2,"user":2,"visited_at":7,"mark":1}`},
+			status: fasthttp.StatusOK,
+			errors: []string{"", ""},
+		},
+		{
+			name:   "unknown type",
+			lines:  []string{`{"type":"user","id":4,"email":"a@x.ru","first_name":"A","last_name":"B","gender":"m","birth_date":0}`, `{"type":"trip","id":1}`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"", "unknown_type"},
+		},
+		{
+			name:   "missing type",
+			lines:  []string{`{"id":4,"email":"a@x.ru","first_name":"A","last_name":"B","gender":"m","birth_date":0}`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"missing_field"},
+		},
+		{
+			name:   "null type",
+			lines:  []string{`{"type":null,"id":4}`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"null_field"},
+		},
+		{
+			name:   "malformed line",
+			lines:  []string{`{"type":"user","id":4`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"malformed_json"},
+		},
+		{
+			name:   "reference to nowhere",
+			lines:  []string{`{"type":"user","id":4,"email":"a@x.ru","first_name":"A","last_name":"B","gender":"m","birth_date":0}`, `{"type":"visit","id":5,"location":9,"user":4,"visited_at":10,"mark":3}`},
+			status: fasthttp.StatusBadRequest,
+			errors: []string{"", "unknown_reference"},
+		},
+	}
+	for _, test := range tests {
+		want := newTestStore(t, 3, 2, 4)
+		s := newTestStore(t, 3, 2, 4)
+		status, response := postImport(t, test.query, test.lines...)
+		if status != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, status, test.status)
+		}
+		applied := test.status == fasthttp.StatusOK
+		if response.Applied != applied || (response.Error == nil) != applied {
+			t.Errorf("%s: applied %v with error %v, want applied %v", test.name, response.Applied, response.Error, applied)
+		}
+		if len(response.Lines) != len(test.errors) {
+			t.Fatalf("%s: %d lines in the answer, want %d", test.name, len(response.Lines), len(test.errors))
+		}
+		for i, line := range response.Lines {
+			code := ""
+			if line.Error != nil {
+				code = line.Error.Code
+			}
+			if line.Line != i+1 || code != test.errors[i] {
+				t.Errorf("%s: line %d answered as line %d with %q, want %q", test.name, i+1, line.Line, code, test.errors[i])
+			}
+		}
+		if !applied {
+			// none of the batch goes in, not even the lines that passed
+			checkSameStore(t, s, want)
+			continue
+		}
+		checkVisitLists(t, s)
+		for i, line := range response.Lines {
+			var found bool
+			switch line.Type {
+			case "user":
+				found = s.User(line.ID) != nil
+			case "location":
+				found = s.Location(line.ID) != nil
+			case "visit":
+				found = s.Visit(line.ID) != nil
+			}
+			if !found {
+				t.Errorf("%s: line %d, %s %d, is not in the store", test.name, i+1, line.Type, line.ID)
+			}
+		}
+	}
+}
+
+// TestImportLogged checks a batch is one WAL record that replays to the
+// same store, and that a batch the WAL refuses is reported as not applied.
+func TestImportLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s := newTestStore(t, 3, 2, 4)
+	w := openTestWAL(t, path, 0)
+	batches := []struct {
+		query string
+		lines []string
+	}{
+		{"", []string{`{"type":"visit","id":5,"location":3,"user":4,"visited_at":10,"mark":3}`, `{"type":"user","id":4,"email":"n@x.ru","first_name":"N","last_name":"U","gender":"f","birth_date":0}`, `{"type":"location","id":3,"place":"A","country":"B","city":"C","distance":1}`}},
+		{"?upsert=1", []string{`{"type":"user","id":1,"email":"up@x.ru","first_name":"U","last_name":"P","gender":"f","birth_date":5}`, `{"type":"visit","id":2,"location":3,"user":1,"visited_at":7,"mark":1}`}},
+	}
+	for i, batch := range batches {
+		if status, response := postImport(t, batch.query, batch.lines...); status != fasthttp.StatusOK || !response.Applied {
+			t.Fatalf("batch %d: status %d, applied %v", i, status, response.Applied)
+		}
+		if w.LSN() != uint64(i+1) {
+			t.Errorf("batch %d: lsn %d, want one record per batch", i, w.LSN())
+		}
+	}
+	closeTestWAL(w)
+
+	replayed := newTestStore(t, 3, 2, 4)
+	w = openTestWAL(t, path, 0)
+	checkSameStore(t, replayed, s)
+
+	w.file.Close()
+	status, response := postImport(t, "", `{"type":"user","id":6,"email":"l@x.ru","first_name":"L","last_name":"W","gender":"m","birth_date":0}`)
+	if status != fasthttp.StatusInternalServerError || response.Applied || response.Error == nil || response.Error.Code != errNotPersisted.Code {
+		t.Errorf("unlogged batch: status %d, applied %v, error %v", status, response.Applied, response.Error)
+	}
+	if replayed.User(6) != nil {
+		t.Error("unlogged batch was applied")
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	jlexer "github.com/mailru/easyjson/jlexer"
+)
+
+// dataFile is one entry of a dataset, either a file in the data directory
+// or a member of the zip archive it was shipped as.
+type dataFile struct {
+	name string
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+func (f dataFile) read() ([]byte, error) {
+	r, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// sniffEntity tells which entity a data file holds from its first top-level
+// key, so file names play no part in how a file is read. It returns 0 for
+// anything that is not a users, locations or visits file.
+func sniffEntity(data []byte) byte {
+	in := jlexer.Lexer{Data: data}
+	in.Delim('{')
+	if !in.Ok() || in.IsDelim('}') {
+		return 0
+	}
+	switch in.UnsafeString() {
+	case "users":
+		return 'u'
+	case "locations":
+		return 'l'
+	case "visits":
+		return 'v'
+	}
+	return 0
+}
+
+// listDir returns the files of a data directory.
+func listDir(dir string) ([]dataFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]dataFile, 0, len(infos))
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		files = append(files, dataFile{info.Name(), info.Size(), func() (io.ReadCloser, error) {
+			return os.Open(name)
+		}})
+	}
+	return files, nil
+}
+
+// listZip returns the members of a zip archive, named by their base name
+// so archives with a top-level folder load the same as flat ones. The
+// returned closer must be closed once loading is done.
+func listZip(name string) ([]dataFile, io.Closer, error) {
+	archive, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]dataFile, 0, len(archive.File))
+	for _, member := range archive.File {
+		if member.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, dataFile{path.Base(member.Name), int64(member.UncompressedSize64), member.Open})
+	}
+	return files, archive, nil
+}
+
+// readOptions returns the dataset date from the first line of options.txt.
+// It is looked up among files first and then in dir, which for a zip
+// archive is the directory holding it.
+func readOptions(files []dataFile, dir string) (int, error) {
+	var opts []byte
+	var err error
+	for _, file := range files {
+		if file.name == "options.txt" {
+			opts, err = file.read()
+			break
+		}
+	}
+	if opts == nil && err == nil {
+		opts, err = ioutil.ReadFile(path.Join(dir, "options.txt"))
+	}
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(string(opts), "\n")
+	date, _ := strconv.Atoi(lines[0])
+	return date, nil
+}
+
+// loadData fills s from a data directory or a zip archive of one. Problems
+// with individual files or records do not stop it; they are collected into
+// the returned report for the caller to log or refuse.
+func loadData(s *Store, dataPath string) (*loadReport, error) {
+	var files []dataFile
+	dir := dataPath
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		files, err = listDir(dataPath)
+	} else {
+		var archive io.Closer
+		files, archive, err = listZip(dataPath)
+		if archive != nil {
+			defer archive.Close()
+		}
+		dir = path.Dir(dataPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.date, err = readOptions(files, dir); err != nil {
+		return nil, err
+	}
+
+	entityFiles := make([]dataFile, 0, len(files))
+	for _, file := range files {
+		if file.name != "options.txt" {
+			entityFiles = append(entityFiles, file)
+		}
+	}
+	sort.SliceStable(entityFiles, func(i, j int) bool {
+		return entityFiles[i].name < entityFiles[j].name
+	})
+
+	return loadFiles(s, entityFiles, *loadWorkers, *loadMemory), nil
+}
+
+// loadIssue is one problem found while loading: a file that could not be
+// read or parsed (ID 0) or a record that was skipped.
+type loadIssue struct {
+	file   string
+	id     int
+	code   string
+	reason string
+}
+
+func (issue loadIssue) String() string {
+	if issue.id == 0 {
+		return issue.file + ": " + issue.reason
+	}
+	return issue.file + " id " + strconv.Itoa(issue.id) + ": " + issue.reason
+}
+
+type loadReport struct {
+	issues []loadIssue
+}
+
+func (r *loadReport) add(file string, id int, err *Error) {
+	r.issues = append(r.issues, loadIssue{file, id, err.Code, err.Error()})
+}
+
+// summarize logs how many issues of each kind were found and the first
+// few of them.
+func (r *loadReport) summarize() {
+	if len(r.issues) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	codes := make([]string, 0)
+	for _, issue := range r.issues {
+		if counts[issue.code] == 0 {
+			codes = append(codes, issue.code)
+		}
+		counts[issue.code]++
+	}
+	sort.Strings(codes)
+	log.Printf("loader: %d issues", len(r.issues))
+	for _, code := range codes {
+		log.Printf("loader:   %s: %d", code, counts[code])
+	}
+	for i, issue := range r.issues {
+		if i == maxLoggedIssues {
+			log.Printf("loader:   ... %d more", len(r.issues)-i)
+			break
+		}
+		log.Printf("loader:   %s", issue)
+	}
+}
+
+const maxLoggedIssues = 20
+
+func unreadableFile(err error) *Error {
+	return &Error{Code: "unreadable_file", Message: err.Error()}
+}
+
+func malformedFile(err error) *Error {
+	return &Error{Code: "malformed_json", Message: err.Error()}
+}
+
+var (
+	errNullRecord  = &Error{Code: "null_record", Message: "record is null"}
+	errUnknownFile = &Error{Code: "unknown_file", Message: "not a users, locations or visits file"}
+)
+
+// parsedFile is the decoded content of one data file with the records that
+// failed validation already dropped and reported in issues.
+type parsedFile struct {
+	index     int
+	name      string
+	users     []*User
+	locations []*Location
+	visits    []*Visit
+	issues    loadReport
+}
+
+// loadFiles reads and decodes files on workers goroutines while the calling
+// goroutine, the only one touching the store, applies the results in the
+// order of files, so a record repeated in a later file wins. Files in
+// flight, from being read until their records are in the store, are capped
+// at memory bytes of raw content; a file larger than the cap is still read,
+// but only once nothing else is held. The budget is taken in file order, so
+// the file the applier waits for next always has it. Every entity is in the
+// store before any visit is linked to its user and location, so files may
+// come in any order and under any name.
+func loadFiles(s *Store, files []dataFile, workers int, memory int64) *loadReport {
+	if workers < 1 {
+		workers = 1
+	}
+	budget := newByteBudget(memory)
+	jobs := make(chan int)
+	results := make(chan *parsedFile, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				parsed := parseFile(files[i])
+				parsed.index = i
+				results <- parsed
+			}
+		}()
+	}
+	go func() {
+		for i := range files {
+			budget.acquire(files[i].size)
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	report := new(loadReport)
+	pending := make([]*parsedFile, 0)
+	waiting := make(map[int]*parsedFile)
+	next := 0
+	for result := range results {
+		waiting[result.index] = result
+		for ; next < len(files); next++ {
+			parsed, ok := waiting[next]
+			if !ok {
+				break
+			}
+			delete(waiting, next)
+			applyParsed(s, parsed, report)
+			budget.release(files[next].size)
+			if len(parsed.visits) > 0 {
+				pending = append(pending, parsed)
+			}
+		}
+	}
+	for _, parsed := range pending {
+		for _, visit := range parsed.visits {
+			// a later file may have replaced this visit
+			if s.Visit(visit.ID) != visit {
+				continue
+			}
+			user, location := s.User(visit.User), s.Location(visit.Location)
+			if user == nil || location == nil {
+				if user == nil {
+					report.add(parsed.name, visit.ID, unknownReference("user"))
+				} else {
+					report.add(parsed.name, visit.ID, unknownReference("location"))
+				}
+				s.RemoveVisit(visit.ID)
+				continue
+			}
+			user.visits.add(visit)
+			visit.userRef = user
+			location.visits.add(visit)
+			visit.locationRef = location
+		}
+	}
+	s.EachUser(func(user *User) {
+		user.visits.sort()
+	})
+	s.EachLocation(func(location *Location) {
+		location.visits.sort()
+	})
+	return report
+}
+
+func applyParsed(s *Store, parsed *parsedFile, report *loadReport) {
+	report.issues = append(report.issues, parsed.issues.issues...)
+	for _, user := range parsed.users {
+		s.SetUser(user)
+	}
+	for _, location := range parsed.locations {
+		s.SetLocation(location)
+	}
+	for _, visit := range parsed.visits {
+		s.SetVisit(visit)
+	}
+}
+
+// parseFile decodes one data file and validates its records. Files ending
+// in .csv are read as CSV, anything else as JSON. A file that cannot be read
+// or parsed at all contributes no records.
+func parseFile(file dataFile) *parsedFile {
+	parsed := &parsedFile{name: file.name}
+	data, err := file.read()
+	if err != nil {
+		parsed.issues.add(file.name, 0, unreadableFile(err))
+		return parsed
+	}
+	var users []*User
+	var locations []*Location
+	var visits []*Visit
+	if strings.HasSuffix(strings.ToLower(file.name), ".csv") {
+		users, locations, visits = parseCSV(file.name, data, &parsed.issues)
+	} else {
+		switch sniffEntity(data) {
+		case 0:
+			parsed.issues.add(file.name, 0, errUnknownFile)
+		case 'u':
+			usersFile := new(UsersFile)
+			if err := usersFile.UnmarshalJSON(data); err != nil {
+				parsed.issues.add(file.name, 0, malformedFile(err))
+				return parsed
+			}
+			users = usersFile.Users
+		case 'l':
+			locationsFile := new(LocationsFile)
+			if err := locationsFile.UnmarshalJSON(data); err != nil {
+				parsed.issues.add(file.name, 0, malformedFile(err))
+				return parsed
+			}
+			locations = locationsFile.Locations
+		case 'v':
+			visitsFile := new(VisitsFile)
+			if err := visitsFile.UnmarshalJSON(data); err != nil {
+				parsed.issues.add(file.name, 0, malformedFile(err))
+				return parsed
+			}
+			visits = visitsFile.Visits
+		}
+	}
+
+	for _, user := range users {
+		if user == nil {
+			parsed.issues.add(file.name, 0, errNullRecord)
+		} else if err := user.Validate(); err != nil {
+			parsed.issues.add(file.name, user.ID, err)
+		} else {
+			parsed.users = append(parsed.users, user)
+		}
+	}
+	for _, location := range locations {
+		if location == nil {
+			parsed.issues.add(file.name, 0, errNullRecord)
+		} else if err := location.Validate(); err != nil {
+			parsed.issues.add(file.name, location.ID, err)
+		} else {
+			parsed.locations = append(parsed.locations, location)
+		}
+	}
+	for _, visit := range visits {
+		if visit == nil {
+			parsed.issues.add(file.name, 0, errNullRecord)
+		} else if err := visit.Validate(); err != nil {
+			parsed.issues.add(file.name, visit.ID, err)
+		} else {
+			parsed.visits = append(parsed.visits, visit)
+		}
+	}
+	return parsed
+}
+
+// byteBudget is a counting semaphore over bytes. A limit of 0 or less
+// disables it.
+type byteBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	b := &byteBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *byteBudget) acquire(n int64) {
+	if b.limit <= 0 {
+		return
+	}
+	b.mu.Lock()
+	for b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.mu.Unlock()
+}
+
+func (b *byteBudget) release(n int64) {
+	if b.limit <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func memoryFile(name string, data []byte) dataFile {
+	return dataFile{name, int64(len(data)), func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}}
+}
+
+// testDataset renders users, locations and visits as data files of at most
+// perFile records each, visits first so linking cannot rely on file order.
+func testDataset(users, locations, visits, perFile int) []dataFile {
+	files := make([]dataFile, 0)
+	write := func(kind string, n int, record func(id int) string) {
+		for first := 1; first <= n; first += perFile {
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, `{"%s":[`, kind)
+			for id := first; id < first+perFile && id <= n; id++ {
+				if id > first {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(record(id))
+			}
+			buf.WriteString("]}")
+			files = append(files, memoryFile(fmt.Sprintf("%s_%d.json", kind, len(files)+1), buf.Bytes()))
+		}
+	}
+	write("visits", visits, func(id int) string {
+		return fmt.Sprintf(`{"id":%d,"location":%d,"user":%d,"visited_at":%d,"mark":%d}`, id, id%locations+1, id%users+1, id*7919%1000000, id%6)
+	})
+	write("users", users, func(id int) string {
+		return fmt.Sprintf(`{"id":%d,"email":"u%d@x.ru","first_name":"F","last_name":"L","gender":"%c","birth_date":%d}`, id, id, "mf"[id%2], -id*1000)
+	})
+	write("locations", locations, func(id int) string {
+		return fmt.Sprintf(`{"id":%d,"place":"P","country":"C","city":"T","distance":%d}`, id, id%100)
+	})
+	return files
+}
+
+func TestLoadFilesMemoryCap(t *testing.T) {
+	files := testDataset(50, 20, 2000, 100)
+	want := NewStore(0, 0, 0)
+	if report := loadFiles(want, files, 1, 0); len(report.issues) > 0 {
+		t.Fatalf("sequential load reported %v", report.issues)
+	}
+	// a cap below the smallest file lets one file through at a time
+	for _, memory := range []int64{0, 1, files[0].size * 3} {
+		s := NewStore(0, 0, 0)
+		if report := loadFiles(s, files, 4, memory); len(report.issues) > 0 {
+			t.Fatalf("memory %d: reported %v", memory, report.issues)
+		}
+		if s.userCount != want.userCount || s.locationCount != want.locationCount || s.visitCount != want.visitCount {
+			t.Errorf("memory %d: loaded %d/%d/%d entities, want %d/%d/%d", memory,
+				s.userCount, s.locationCount, s.visitCount, want.userCount, want.locationCount, want.visitCount)
+		}
+		want.EachUser(func(user *User) {
+			if got := listIDs(&s.User(user.ID).visits); !sameIDs(got, listIDs(&user.visits)) {
+				t.Errorf("memory %d: user %d has visits %v, want %v", memory, user.ID, got, listIDs(&user.visits))
+			}
+		})
+		checkVisitLists(t, s)
+	}
+}
+
+// BenchmarkLoadFiles compares a sequential load with a parallel one; on
+// fewer than four CPUs the parallel run still uses four workers, which shows
+// the overhead of reordering results.
+func BenchmarkLoadFiles(b *testing.B) {
+	files := testDataset(10000, 5000, 200000, 10000)
+	parallel := runtime.NumCPU()
+	if parallel < 4 {
+		parallel = 4
+	}
+	for _, workers := range []int{1, parallel} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				loadFiles(NewStore(0, 0, 0), files, workers, 0)
+			}
+		})
+	}
+}
+
+// writeZip packs files into a zip archive at name, under folder if it is
+// not empty, with options.txt alongside them when options is set.
+func writeZip(t *testing.T, name, folder string, files []dataFile, options string) {
+	t.Helper()
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := zip.NewWriter(out)
+	if folder != "" {
+		if _, err := w.Create(folder + "/"); err != nil {
+			t.Fatal(err)
+		}
+		folder += "/"
+	}
+	add := func(name string, data []byte) {
+		member, err := w.Create(folder + name)
+		if err == nil {
+			_, err = member.Write(data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range files {
+		data, err := file.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(file.name, data)
+	}
+	if options != "" {
+		add("options.txt", []byte(options))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadZip(t *testing.T) {
+	files := testDataset(30, 10, 300, 100)
+	want := NewStore(0, 0, 0)
+	if report := loadFiles(want, files, 1, 0); len(report.issues) > 0 {
+		t.Fatalf("reference load reported %v", report.issues)
+	}
+	tests := []struct {
+		name, folder string
+		// where options.txt goes: in the archive, next to it, or both
+		inside, beside bool
+	}{
+		{"flat", "", true, false},
+		{"top-level folder", "data", true, false},
+		{"options beside the archive", "data", false, true},
+		{"options in both", "", true, true},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "data.zip")
+		options := ""
+		if test.inside {
+			options = "1503695452\n1\n"
+		}
+		writeZip(t, name, test.folder, files, options)
+		if test.beside {
+			if err := ioutil.WriteFile(filepath.Join(dir, "options.txt"), []byte("1400000000\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s := NewStore(0, 0, 0)
+		report, err := loadData(s, name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(report.issues) > 0 {
+			t.Errorf("%s: reported %v", test.name, report.issues)
+		}
+		wantDate := 1503695452
+		if !test.inside {
+			wantDate = 1400000000
+		}
+		if s.date != wantDate {
+			t.Errorf("%s: dataset date %d, want %d", test.name, s.date, wantDate)
+		}
+		checkSameStore(t, s, want)
+	}
+
+	// an archive without options.txt anywhere cannot be loaded
+	dir := t.TempDir()
+	writeZip(t, filepath.Join(dir, "data.zip"), "data", files, "")
+	if _, err := loadData(NewStore(0, 0, 0), filepath.Join(dir, "data.zip")); err == nil {
+		t.Error("loaded an archive without options.txt")
+	}
+}
@@ -1,27 +1,54 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
-	"path"
 	"runtime"
 	"runtime/debug"
-	"sort"
-	"strconv"
-	"strings"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
-var users [1500200]*User
-var locations [1000000]*Location
-var visits [10500000]*Visit
-var currentDate int
+// wal logs every mutation when -wal is set. Its methods are no-ops on nil.
+var wal *WAL
+
+var (
+	usersCap     = flag.Int("users", 0, "initial capacity of the users table")
+	locationsCap = flag.Int("locations", 0, "initial capacity of the locations table")
+	visitsCap    = flag.Int("visits", 0, "initial capacity of the visits table")
+
+	loadWorkers = flag.Int("load-workers", runtime.NumCPU(), "goroutines decoding data files in parallel; 1 loads sequentially")
+	loadMemory  = flag.Int64("load-memory", 0, "cap in bytes on raw file contents held by the loader at once; 0 is unlimited")
+	strictLoad  = flag.Bool("strict", false, "refuse to start if any data file or record is unreadable, invalid or dangling")
+
+	walPath         = flag.String("wal", "", "append mutations to this write-ahead log and replay it on start")
+	walSync         = flag.String("wal-sync", syncInterval, "when to fsync the WAL: always, interval or never")
+	walSyncInterval = flag.Duration("wal-sync-interval", time.Second, "fsync period for -wal-sync=interval")
+
+	snapshotDir      = flag.String("snapshot-dir", "", "write periodic snapshots here and boot from the newest one")
+	snapshotInterval = flag.Duration("snapshot-interval", 10*time.Minute, "how often to write a snapshot")
+
+	clockSource  = flag.String("clock", clockFixed, "time ages are computed against: fixed (options.txt) or wall")
+	adminEnabled = flag.Bool("admin", false, "serve the /admin endpoints")
+
+	deletePolicy = flag.String("delete-policy", deleteReject, "deleting a user or location with visits: reject (409) or cascade")
+)
+
+const (
+	deleteReject  = "reject"
+	deleteCascade = "cascade"
+)
+
+const (
+	clockFixed = "fixed"
+	clockWall  = "wall"
+)
 
 func main() {
-	args := os.Args[1:]
+	flag.Parse()
+	args := flag.Args()
 	dataPath := "/data"
 	if len(args) > 0 {
 		dataPath = args[0]
@@ -34,122 +61,74 @@ func main() {
 	fmt.Println(dataPath)
 	fmt.Println(port)
 
-	loadData(dataPath)
-
-	requestHandler := func(ctx *fasthttp.RequestCtx) {
-		path := string(ctx.Path())
-		parts := strings.Split(path, "/")
-		if len(parts) < 3 || len(parts[1]) < 1 || len(parts[2]) < 1 {
-			ctx.SetStatusCode(fasthttp.StatusNotFound)
-			return
-		}
-		var body []byte
-		p1 := parts[1][0]
-		p2 := parts[2][0]
-		l := len(parts)
-		switch {
-		case ctx.IsGet() && l == 4 && p1 == 'l' && len(parts[3]) > 0 && parts[3][0] == 'a':
-			body = Avg(ctx, parts[2])
-		case ctx.IsGet() && l == 3 && (p1 == 'u' || p1 == 'l' || p1 == 'v'):
-			body = EntityById(ctx, p1, parts[2])
-		case ctx.IsGet() && l == 4 && p1 == 'u' && len(parts[3]) > 0 && parts[3][0] == 'v':
-			body = Visits(ctx, parts[2])
-		case ctx.IsPost() && l == 3 && p2 == 'n' && (p1 == 'u' || p1 == 'l' || p1 == 'v'):
-			body = Create(ctx, p1)
-		case ctx.IsPost() && l == 3 && (p1 == 'u' || p1 == 'l' || p1 == 'v'):
-			body = Update(ctx, p1, parts[2])
-		default:
-			ctx.SetStatusCode(fasthttp.StatusNotFound)
-		}
-
-		if body != nil && len(body) > 0 {
-			ctx.Response.Header.SetContentLength(len(body))
-			ctx.Response.Header.SetContentTypeBytes(contentTypeBytes)
-			ctx.SetBody(body)
-		}
+	if *deletePolicy != deleteReject && *deletePolicy != deleteCascade {
+		log.Fatalf("unknown -delete-policy %q", *deletePolicy)
 	}
-
-	err := fasthttp.ListenAndServe(":"+port, requestHandler)
-	if err != nil {
-		log.Fatal(err)
+	if *clockSource != clockFixed && *clockSource != clockWall {
+		log.Fatalf("unknown -clock %q", *clockSource)
 	}
-}
 
-func fileOrder(path string) int {
-	if strings.HasPrefix(path, "users") {
-		return 0
+	debug.SetGCPercent(50)
+	store := NewStore(*usersCap, *locationsCap, *visitsCap)
+	live.Store(store)
+	var lsn uint64
+	var fromSnapshot bool
+	if *snapshotDir != "" {
+		start := time.Now()
+		lsn, fromSnapshot = LoadSnapshot(store, *snapshotDir)
+		loadTimes.snapshot = int64(time.Since(start))
 	}
-
-	if strings.HasPrefix(path, "locations") {
-		return 1
+	if !fromSnapshot {
+		start := time.Now()
+		report, err := loadData(store, dataPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.summarize()
+		if *strictLoad && len(report.issues) > 0 {
+			log.Fatalf("loader: strict mode, aborting on %d issues", len(report.issues))
+		}
+		loadTimes.json = int64(time.Since(start))
 	}
+	fmt.Println(store.date)
 
-	if strings.HasPrefix(path, "visits") {
-		return 2
+	// replaying a reload from the WAL moves it on
+	reloadPath = dataPath
+	if *walPath != "" {
+		if *walSync != syncAlways && *walSync != syncInterval && *walSync != syncNever {
+			log.Fatalf("unknown -wal-sync policy %q", *walSync)
+		}
+		var err error
+		start := time.Now()
+		wal, err = OpenWAL(*walPath, *walSync, *walSyncInterval, lsn, replayWAL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		loadTimes.wal = int64(time.Since(start))
 	}
+	if *clockSource == clockFixed {
+		clock.base = datasetClock{}
+	}
+	runtime.GC()
+	debug.SetGCPercent(-1)
 
-	return 10
-}
-
-func loadData(dir string) {
-	debug.SetGCPercent(50)
-	opts, err := ioutil.ReadFile(path.Join(dir, "options.txt"))
-	if err != nil {
-		log.Fatal(err)
+	if *snapshotDir != "" {
+		go snapshotLoop(*snapshotDir, *snapshotInterval)
 	}
-	lines := strings.Split(string(opts), "\n")
-	currentDate, _ = strconv.Atoi(lines[0])
-	fmt.Println(currentDate)
+	go reloadOnSignal()
 
-	files, err := ioutil.ReadDir(dir)
+	err := fasthttp.ListenAndServe(":"+port, newRouter().Serve)
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	sort.Slice(files, func(i, j int) bool {
-		return fileOrder(files[i].Name()) < fileOrder(files[j].Name())
-	})
-
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), "users") {
-			data, _ := ioutil.ReadFile(path.Join(dir, file.Name()))
-			usersFile := new(UsersFile)
-			usersFile.UnmarshalJSON(data)
-			for _, user := range usersFile.Users {
-				users[user.ID] = user
-				user.visits = make([]*Visit, 10)
-				user.CalculateAge()
-			}
-		}
-		if strings.HasPrefix(file.Name(), "locations") {
-			data, _ := ioutil.ReadFile(path.Join(dir, file.Name()))
-			locationsFile := new(LocationsFile)
-			locationsFile.UnmarshalJSON(data)
-			for _, location := range locationsFile.Locations {
-				locations[location.ID] = location
-				location.visits = make([]*Visit, 10)
-			}
-		}
-		if strings.HasPrefix(file.Name(), "visits") {
-			data, _ := ioutil.ReadFile(path.Join(dir, file.Name()))
-			visitsFile := new(VisitsFile)
-			visitsFile.UnmarshalJSON(data)
-			for _, visit := range visitsFile.Visits {
-				visits[visit.ID] = visit
-
-				location := locations[visit.Location]
-				location.visits = append(location.visits, visit)
-				visit.locationRef = location
-
-				user := users[visit.User]
-				user.visits = append(user.visits, visit)
-				visit.userRef = user
-			}
-		}
+func writeJSON(ctx *fasthttp.RequestCtx, body []byte) {
+	if len(body) > 0 {
+		ctx.Response.Header.SetContentLength(len(body))
+		ctx.Response.Header.SetContentTypeBytes(contentTypeBytes)
+		ctx.SetBody(body)
 	}
-
-	runtime.GC()
-	debug.SetGCPercent(-1)
 }
 
 var contentTypeBytes = []byte("application/json")
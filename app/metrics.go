@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	routeEntity = iota
+	routeVisits
+	routeAvg
+	routeCreate
+	routeUpdate
+	routeDelete
+	routeImport
+	routeExport
+	routeMetrics
+	routeAdmin
+	routeUnknown
+	routeCount
+)
+
+var routeNames = [routeCount]string{"entity", "visits", "avg", "create", "update", "delete", "import", "export", "metrics", "admin", "unknown"}
+
+// latencyBuckets are histogram upper bounds in microseconds.
+var latencyBuckets = [...]int64{50, 100, 250, 500, 1000, 2500, 5000, 10000, 50000, 250000}
+
+var statusCodes = [...]int{200, 202, 400, 404, 405, 409, 500}
+
+// routeStats holds lock-free counters for one route. Observing a request
+// is a handful of atomic adds; all formatting happens on scrape.
+type routeStats struct {
+	statuses [len(statusCodes) + 1]uint64
+	buckets  [len(latencyBuckets) + 1]uint64
+	sumNanos uint64
+}
+
+var metrics [routeCount]routeStats
+
+// loadTimes records how long each startup phase took, in nanoseconds.
+var loadTimes struct {
+	json, snapshot, wal int64
+}
+
+func observe(route int, status int, elapsed time.Duration) {
+	m := &metrics[route]
+	i := 0
+	for i < len(statusCodes) && statusCodes[i] != status {
+		i++
+	}
+	atomic.AddUint64(&m.statuses[i], 1)
+
+	us := int64(elapsed / time.Microsecond)
+	b := 0
+	for b < len(latencyBuckets) && us > latencyBuckets[b] {
+		b++
+	}
+	atomic.AddUint64(&m.buckets[b], 1)
+	atomic.AddUint64(&m.sumNanos, uint64(elapsed))
+}
+
+func Metrics(ctx *fasthttp.RequestCtx) {
+	var out bytes.Buffer
+
+	out.WriteString("# HELP hlcup_requests_total Requests served by route and status code.\n")
+	out.WriteString("# TYPE hlcup_requests_total counter\n")
+	for route := range metrics {
+		m := &metrics[route]
+		for i := range m.statuses {
+			code := "other"
+			if i < len(statusCodes) {
+				code = strconv.Itoa(statusCodes[i])
+			}
+			fmt.Fprintf(&out, "hlcup_requests_total{route=%q,code=%q} %d\n", routeNames[route], code, atomic.LoadUint64(&m.statuses[i]))
+		}
+	}
+
+	out.WriteString("# HELP hlcup_request_duration_seconds Request latency by route.\n")
+	out.WriteString("# TYPE hlcup_request_duration_seconds histogram\n")
+	for route := range metrics {
+		m := &metrics[route]
+		var total uint64
+		for i := range m.buckets {
+			total += atomic.LoadUint64(&m.buckets[i])
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(float64(latencyBuckets[i])/1e6, 'g', -1, 64)
+			}
+			fmt.Fprintf(&out, "hlcup_request_duration_seconds_bucket{route=%q,le=%q} %d\n", routeNames[route], le, total)
+		}
+		fmt.Fprintf(&out, "hlcup_request_duration_seconds_sum{route=%q} %g\n", routeNames[route], float64(atomic.LoadUint64(&m.sumNanos))/1e9)
+		fmt.Fprintf(&out, "hlcup_request_duration_seconds_count{route=%q} %d\n", routeNames[route], total)
+	}
+
+	s := currentStore()
+	s.RLock()
+	users, locations, visits := s.userCount, s.locationCount, s.visitCount
+	s.RUnlock()
+	slots, tombstones := atomic.LoadInt64(&listSlots), atomic.LoadInt64(&listTombstones)
+	out.WriteString("# HELP hlcup_entities Entities currently in the store.\n")
+	out.WriteString("# TYPE hlcup_entities gauge\n")
+	fmt.Fprintf(&out, "hlcup_entities{type=\"users\"} %d\n", users)
+	fmt.Fprintf(&out, "hlcup_entities{type=\"locations\"} %d\n", locations)
+	fmt.Fprintf(&out, "hlcup_entities{type=\"visits\"} %d\n", visits)
+
+	ratio := 0.0
+	if slots > 0 {
+		ratio = float64(tombstones) / float64(slots)
+	}
+	out.WriteString("# HELP hlcup_visit_list_slots Slots in user and location visit lists, tombstones included.\n")
+	out.WriteString("# TYPE hlcup_visit_list_slots gauge\n")
+	fmt.Fprintf(&out, "hlcup_visit_list_slots %d\n", slots)
+	out.WriteString("# HELP hlcup_visit_list_tombstone_ratio Share of visit list slots that are tombstones awaiting compaction.\n")
+	out.WriteString("# TYPE hlcup_visit_list_tombstone_ratio gauge\n")
+	fmt.Fprintf(&out, "hlcup_visit_list_tombstone_ratio %g\n", ratio)
+
+	out.WriteString("# HELP hlcup_load_duration_seconds Time spent in each startup loading phase.\n")
+	out.WriteString("# TYPE hlcup_load_duration_seconds gauge\n")
+	fmt.Fprintf(&out, "hlcup_load_duration_seconds{phase=\"json\"} %g\n", time.Duration(atomic.LoadInt64(&loadTimes.json)).Seconds())
+	fmt.Fprintf(&out, "hlcup_load_duration_seconds{phase=\"snapshot\"} %g\n", time.Duration(atomic.LoadInt64(&loadTimes.snapshot)).Seconds())
+	fmt.Fprintf(&out, "hlcup_load_duration_seconds{phase=\"wal\"} %g\n", time.Duration(atomic.LoadInt64(&loadTimes.wal)).Seconds())
+
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.SetBody(out.Bytes())
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	jwriter "github.com/mailru/easyjson/jwriter"
+	"github.com/valyala/fasthttp"
+)
+
+// MessagePack is offered next to JSON for clients that ask for it in
+// Accept, and read from POST bodies sent with a MessagePack Content-Type.
+// Encoded maps carry the JSON field names in the JSON field order.
+
+var contentTypeMsgpack = []byte("application/msgpack")
+
+var errMalformedMsgpack = &Error{fasthttp.StatusBadRequest, "malformed_msgpack", "", "request body is not a MessagePack map of scalar values"}
+
+// encodable is a response body that can be written in either format.
+type encodable interface {
+	MarshalJSON() ([]byte, error)
+	MarshalMsgpack() []byte
+}
+
+// encode returns v as JSON, or, when the client prefers MessagePack, puts
+// it in the response itself and returns nil so writeJSON leaves it alone.
+func encode(ctx *fasthttp.RequestCtx, v encodable) []byte {
+	if wantsMsgpack(ctx.Request.Header.Peek("Accept")) {
+		ctx.SetContentTypeBytes(contentTypeMsgpack)
+		ctx.SetBody(v.MarshalMsgpack())
+		return nil
+	}
+	data, _ := v.MarshalJSON()
+	return data
+}
+
+// wantsMsgpack reports whether an Accept header rates MessagePack at least
+// as high as JSON. Wildcards count for JSON, which stays the default.
+func wantsMsgpack(accept []byte) bool {
+	if !containsFold(accept, msgpackBytes) {
+		return false
+	}
+	msgpackQ, jsonQ := 0.0, 0.0
+	for _, item := range bytes.Split(accept, []byte{','}) {
+		params := bytes.Split(item, []byte{';'})
+		mediaType := string(bytes.ToLower(bytes.TrimSpace(params[0])))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = bytes.TrimSpace(param)
+			if bytes.HasPrefix(param, []byte("q=")) {
+				if v, err := fasthttp.ParseUfloat(param[2:]); err == nil {
+					q = v
+				}
+			}
+		}
+		switch mediaType {
+		case "application/msgpack", "application/x-msgpack":
+			msgpackQ = math.Max(msgpackQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = math.Max(jsonQ, q)
+		}
+	}
+	return msgpackQ > 0 && msgpackQ >= jsonQ
+}
+
+var msgpackBytes = []byte("msgpack")
+
+// isMsgpack reports whether a Content-Type names MessagePack.
+func isMsgpack(contentType []byte) bool {
+	return containsFold(contentType, msgpackBytes)
+}
+
+// containsFold is bytes.Contains ignoring ASCII case, as media types are
+// compared, without lowering a copy of the header on every request.
+func containsFold(b, sub []byte) bool {
+	for i := 0; i+len(sub) <= len(b); i++ {
+		if bytes.EqualFold(b[i:i+len(sub)], sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestBody returns the POST body as JSON, transcoding it first if it was
+// sent as MessagePack, so the mutation paths and the WAL only see JSON.
+func requestBody(ctx *fasthttp.RequestCtx) ([]byte, *Error) {
+	body := ctx.PostBody()
+	if !isMsgpack(ctx.Request.Header.ContentType()) {
+		return body, nil
+	}
+	r := msgpackReader{data: body}
+	w := jwriter.Writer{}
+	r.transcodeObject(&w)
+	if r.err || len(r.data) > 0 {
+		return nil, errMalformedMsgpack
+	}
+	return w.Buffer.BuildBytes(), nil
+}
+
+// msgpackWriter appends MessagePack values to buf.
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) mapHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xde, byte(n>>8), byte(n))
+	default:
+		w.buf = append(w.buf, 0xdf)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	}
+}
+
+func (w *msgpackWriter) arrayHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xdc, byte(n>>8), byte(n))
+	default:
+		w.buf = append(w.buf, 0xdd)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	}
+}
+
+func (w *msgpackWriter) string(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		w.buf = append(w.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, 0xda, byte(n>>8), byte(n))
+	default:
+		w.buf = append(w.buf, 0xdb)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(n))
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) int(i int) {
+	switch {
+	case i >= 0 && i < 128:
+		w.buf = append(w.buf, byte(i))
+	case i < 0 && i >= -32:
+		w.buf = append(w.buf, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		w.buf = append(w.buf, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		w.buf = append(w.buf, 0xd1, byte(i>>8), byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		w.buf = append(w.buf, 0xd2)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(i))
+	default:
+		w.buf = append(w.buf, 0xd3)
+		w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(i))
+	}
+}
+
+func (w *msgpackWriter) float(f float64) {
+	w.buf = append(w.buf, 0xcb)
+	w.buf = binary.BigEndian.AppendUint64(w.buf, math.Float64bits(f))
+}
+
+func (user *User) MarshalMsgpack() []byte {
+	w := msgpackWriter{buf: make([]byte, 0, 128)}
+	w.mapHeader(6)
+	w.string("id")
+	w.int(user.ID)
+	w.string("birth_date")
+	w.int(user.BirthDate)
+	w.string("email")
+	w.string(user.Email)
+	w.string("first_name")
+	w.string(user.FirstName)
+	w.string("last_name")
+	w.string(user.LastName)
+	w.string("gender")
+	w.string(user.Gender)
+	return w.buf
+}
+
+func (location *Location) MarshalMsgpack() []byte {
+	w := msgpackWriter{buf: make([]byte, 0, 128)}
+	w.mapHeader(5)
+	w.string("id")
+	w.int(location.ID)
+	w.string("distance")
+	w.int(location.Distance)
+	w.string("place")
+	w.string(location.Place)
+	w.string("country")
+	w.string(location.Country)
+	w.string("city")
+	w.string(location.City)
+	return w.buf
+}
+
+func (visit *Visit) MarshalMsgpack() []byte {
+	w := msgpackWriter{buf: make([]byte, 0, 64)}
+	w.mapHeader(5)
+	w.string("id")
+	w.int(visit.ID)
+	w.string("location")
+	w.int(visit.Location)
+	w.string("user")
+	w.int(visit.User)
+	w.string("visited_at")
+	w.int(visit.VisitedAt)
+	w.string("mark")
+	w.int(visit.Mark)
+	return w.buf
+}
+
+func (v VisitsResult) MarshalMsgpack() []byte {
+	w := msgpackWriter{buf: make([]byte, 0, 16+32*len(v.Visits))}
+	if v.Next != "" {
+		w.mapHeader(2)
+	} else {
+		w.mapHeader(1)
+	}
+	w.string("visits")
+	w.arrayHeader(len(v.Visits))
+	for _, visit := range v.Visits {
+		w.mapHeader(3)
+		w.string("mark")
+		w.int(visit.Mark)
+		w.string("visited_at")
+		w.int(visit.VisitedAt)
+		w.string("place")
+		w.string(visit.Place)
+	}
+	if v.Next != "" {
+		w.string("next")
+		w.string(v.Next)
+	}
+	return w.buf
+}
+
+func (v AvgResult) MarshalMsgpack() []byte {
+	w := msgpackWriter{buf: make([]byte, 0, 16)}
+	w.mapHeader(1)
+	w.string("avg")
+	w.float(v.Avg)
+	return w.buf
+}
+
+func (e *Error) MarshalMsgpack() []byte {
+	w := msgpackWriter{buf: make([]byte, 0, 64)}
+	if e.Field != "" {
+		w.mapHeader(3)
+	} else {
+		w.mapHeader(2)
+	}
+	w.string("code")
+	w.string(e.Code)
+	if e.Field != "" {
+		w.string("field")
+		w.string(e.Field)
+	}
+	w.string("message")
+	w.string(e.Message)
+	return w.buf
+}
+
+// emptyObject is the {} acknowledging a successful mutation.
+type emptyObject struct{}
+
+func (emptyObject) MarshalJSON() ([]byte, error) {
+	return emptyJSON, nil
+}
+
+func (emptyObject) MarshalMsgpack() []byte {
+	return emptyMsgpack
+}
+
+var emptyMsgpack = []byte{0x80}
+
+// msgpackReader consumes MessagePack values from data. err is set on
+// truncated input, a type with no JSON equivalent or, since entity bodies
+// are flat maps, any nesting.
+type msgpackReader struct {
+	data []byte
+	err  bool
+}
+
+func (r *msgpackReader) next(n int) []byte {
+	if r.err || n > len(r.data) {
+		r.err = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *msgpackReader) uint(n int) uint64 {
+	b := r.next(n)
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// transcodeObject copies a map of string keys to scalar values to w as a
+// JSON object. A nested map or array is an error rather than something to
+// recurse into, which keeps the work a body can cause linear in its size.
+func (r *msgpackReader) transcodeObject(w *jwriter.Writer) {
+	b := r.next(1)
+	if r.err {
+		return
+	}
+	var n int
+	switch c := b[0]; {
+	case c&0xf0 == 0x80:
+		n = int(c & 0x0f)
+	case c == 0xde:
+		n = int(r.uint(2))
+	case c == 0xdf:
+		n = int(r.uint(4))
+	default:
+		r.err = true
+		return
+	}
+	w.RawByte('{')
+	for i := 0; i < n && !r.err; i++ {
+		if i > 0 {
+			w.RawByte(',')
+		}
+		if len(r.data) == 0 || !(r.data[0]&0xe0 == 0xa0 || r.data[0] == 0xd9 || r.data[0] == 0xda || r.data[0] == 0xdb) {
+			r.err = true
+			return
+		}
+		r.transcodeScalar(w)
+		w.RawByte(':')
+		r.transcodeScalar(w)
+	}
+	w.RawByte('}')
+}
+
+// transcodeScalar copies one value other than a map or array to w as JSON.
+func (r *msgpackReader) transcodeScalar(w *jwriter.Writer) {
+	b := r.next(1)
+	if r.err {
+		return
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		w.Int(int(c))
+	case c >= 0xe0:
+		w.Int(int(int8(c)))
+	case c&0xe0 == 0xa0:
+		w.String(string(r.next(int(c & 0x1f))))
+	case c == 0xc0:
+		w.RawString("null")
+	case c == 0xc2:
+		w.Bool(false)
+	case c == 0xc3:
+		w.Bool(true)
+	case c == 0xca:
+		w.Float32(math.Float32frombits(uint32(r.uint(4))))
+	case c == 0xcb:
+		w.Float64(math.Float64frombits(r.uint(8)))
+	case c == 0xcc:
+		w.Uint64(r.uint(1))
+	case c == 0xcd:
+		w.Uint64(r.uint(2))
+	case c == 0xce:
+		w.Uint64(r.uint(4))
+	case c == 0xcf:
+		w.Uint64(r.uint(8))
+	case c == 0xd0:
+		w.Int64(int64(int8(r.uint(1))))
+	case c == 0xd1:
+		w.Int64(int64(int16(r.uint(2))))
+	case c == 0xd2:
+		w.Int64(int64(int32(r.uint(4))))
+	case c == 0xd3:
+		w.Int64(int64(r.uint(8)))
+	case c == 0xd9:
+		w.String(string(r.next(int(r.uint(1)))))
+	case c == 0xda:
+		w.String(string(r.next(int(r.uint(2)))))
+	case c == 0xdb:
+		w.String(string(r.next(int(r.uint(4)))))
+	default:
+		// maps, arrays, binary and extension types
+		r.err = true
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	jwriter "github.com/mailru/easyjson/jwriter"
+	"github.com/valyala/fasthttp"
+)
+
+func postMsgpack(r *Router, path string, body []byte) (int, string) {
+	ctx := newRequest(path)
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/msgpack")
+	ctx.Request.SetBody(body)
+	r.Serve(ctx)
+	return ctx.Response.StatusCode(), string(ctx.Response.Body())
+}
+
+func TestMsgpackBodies(t *testing.T) {
+	s := newTestStore(t, 2, 2, 4)
+	r := newRouter()
+
+	// {"a": [[[[...]]]]} nested four million deep used to overflow the
+	// stack of the recursive transcoder
+	deep := append([]byte("\x81\xa1a"), bytes.Repeat([]byte{0x91}, 4000000)...)
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"deeply nested", deep},
+		{"nested map", []byte("\x81\xa1a\x81\xa1b\x01")},
+		{"nested array", []byte("\x81\xa1a\x91\x01")},
+		{"array body", []byte("\x91\x01")},
+		{"integer key", []byte("\x81\x01\x01")},
+		{"truncated", []byte("\x82\xa5email")},
+		{"huge map count", []byte("\xdf\xff\xff\xff\xff\xa1a\x01")},
+		{"binary value", []byte("\x81\xa1a\xc4\x01x")},
+		{"trailing bytes", []byte("\x80\x80")},
+		{"empty", nil},
+	}
+	for _, test := range tests {
+		status, body := postMsgpack(r, "/users/1", test.body)
+		if status != 400 || !bytes.Contains([]byte(body), []byte("malformed_msgpack")) {
+			t.Errorf("%s: %d %s", test.name, status, body)
+		}
+	}
+
+	// {"first_name": "Ann", "birth_date": -5}
+	status, body := postMsgpack(r, "/users/1", []byte("\x82\xaafirst_name\xa3Ann\xaabirth_date\xfb"))
+	if status != 200 || s.User(1).FirstName != "Ann" || s.User(1).BirthDate != -5 {
+		t.Errorf("flat body: %d %s, user %+v", status, body, s.User(1))
+	}
+}
+
+func TestWantsMsgpack(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"*/*", false},
+		{"application/msgpack", true},
+		{"application/x-msgpack", true},
+		{"Application/MsgPack", true},
+		{"text/msgpack-ish", false},
+		// an equal q goes to MessagePack, wildcards included
+		{"application/json, application/msgpack", true},
+		{"*/*, application/msgpack", true},
+		{"application/*;q=0.5, application/msgpack;q=0.5", true},
+		{"application/msgpack;q=0.5, application/json", false},
+		{"application/json;q=0.5, application/msgpack", true},
+		{"*/*;q=1, application/msgpack;q=0.9", false},
+		{"application/*;q=0.8, application/msgpack;q=0.9", true},
+		{"application/msgpack ; q=0.4 , application/json ; q=0.3", true},
+		{"application/msgpack;q=0.2, application/x-msgpack;q=0.7, application/json;q=0.6", true},
+		{"application/msgpack;q=0", false},
+		{"application/msgpack;q=0, */*;q=0", false},
+	}
+	for _, test := range tests {
+		if got := wantsMsgpack([]byte(test.accept)); got != test.want {
+			t.Errorf("Accept %q: got %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
+
+// msgpackToJSON renders a MessagePack value as JSON, nested maps and arrays
+// included, so an encoding can be compared with its JSON counterpart.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	r := &msgpackReader{data: data}
+	w := jwriter.Writer{}
+	if err := msgpackValue(r, &w); err != nil {
+		return nil, err
+	}
+	if r.err || len(r.data) > 0 {
+		return nil, fmt.Errorf("%d bytes left over", len(r.data))
+	}
+	return w.Buffer.BuildBytes(), nil
+}
+
+func msgpackValue(r *msgpackReader, w *jwriter.Writer) error {
+	if len(r.data) == 0 {
+		return fmt.Errorf("truncated")
+	}
+	c := r.data[0]
+	n, isMap := 0, false
+	switch {
+	case c&0xf0 == 0x80:
+		n, isMap = int(c&0x0f), true
+	case c == 0xde:
+		n, isMap = int(binary.BigEndian.Uint16(r.next(3)[1:])), true
+	case c == 0xdf:
+		n, isMap = int(binary.BigEndian.Uint32(r.next(5)[1:])), true
+	case c&0xf0 == 0x90:
+		n = int(c & 0x0f)
+	case c == 0xdc:
+		n = int(binary.BigEndian.Uint16(r.next(3)[1:]))
+	case c == 0xdd:
+		n = int(binary.BigEndian.Uint32(r.next(5)[1:]))
+	default:
+		r.transcodeScalar(w)
+		if r.err {
+			return fmt.Errorf("bad scalar %#x", c)
+		}
+		return nil
+	}
+	if c&0xf0 == 0x80 || c&0xf0 == 0x90 {
+		r.next(1)
+	}
+	open, close := byte('['), byte(']')
+	if isMap {
+		open, close = '{', '}'
+	}
+	w.RawByte(open)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.RawByte(',')
+		}
+		if isMap {
+			if err := msgpackValue(r, w); err != nil {
+				return err
+			}
+			w.RawByte(':')
+		}
+		if err := msgpackValue(r, w); err != nil {
+			return err
+		}
+	}
+	w.RawByte(close)
+	return nil
+}
+
+// TestMarshalMsgpack decodes every MessagePack encoding and expects the
+// JSON encoding of the same value, fields in the same order.
+func TestMarshalMsgpack(t *testing.T) {
+	long := strings.Repeat("ы", 200)
+	visits := make([]VisitResult, 20)
+	for i := range visits {
+		visits[i] = VisitResult{Mark: i % 6, VisitedAt: -1 << uint(i), Place: long[:2*i]}
+	}
+	tests := []struct {
+		name string
+		v    encodable
+	}{
+		{"user", &User{ID: 1, BirthDate: -1 << 40, Email: "a@x.ru", FirstName: "Анна", LastName: long, Gender: "f"}},
+		{"user at the limits", &User{ID: math.MaxInt32, BirthDate: math.MinInt32, Email: long[:32], FirstName: long[:300], LastName: "", Gender: "m"}},
+		{"location", &Location{ID: 127, Distance: 128, Place: "Pier \"7\"", Country: "Côte d'Ivoire", City: "x\ny"}},
+		{"visit", &Visit{ID: 255, Location: 256, User: 65536, VisitedAt: -33, Mark: -32}},
+		{"visits", VisitsResult{Visits: visits[:3]}},
+		{"visits with next", VisitsResult{Visits: visits, Next: "opaque-cursor"}},
+		{"no visits", VisitsResult{Visits: []VisitResult{}}},
+		{"error", errNotFound},
+		{"error without field", errRouteNotFound},
+		{"empty object", emptyObject{}},
+	}
+	for _, test := range tests {
+		got, err := msgpackToJSON(test.v.MarshalMsgpack())
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		want, _ := test.v.MarshalJSON()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: decodes to %s, want %s", test.name, got, want)
+		}
+	}
+
+	// JSON rounds averages, MessagePack sends the float as is
+	for _, avg := range []float64{0, 3.14159, 1.0 / 3} {
+		data := AvgResult{Avg: avg}.MarshalMsgpack()
+		want := append([]byte("\x81\xa3avg\xcb"), make([]byte, 8)...)
+		binary.BigEndian.PutUint64(want[len(want)-8:], math.Float64bits(avg))
+		if !bytes.Equal(data, want) {
+			t.Errorf("avg %v: % x, want % x", avg, data, want)
+		}
+	}
+}
+
+// TestMsgpackResponses asks the router for MessagePack and expects it for
+// results and errors alike, with JSON for everyone else.
+func TestMsgpackResponses(t *testing.T) {
+	newTestStore(t, 4, 2, 12)
+	r := newRouter()
+	tests := []struct {
+		uri    string
+		status int
+	}{
+		{"/users/1", fasthttp.StatusOK},
+		{"/users/1/visits?limit=1", fasthttp.StatusOK},
+		{"/locations/1/avg", fasthttp.StatusOK},
+		{"/users/99", fasthttp.StatusNotFound},
+		{"/users/1/visits?limit=x", fasthttp.StatusBadRequest},
+		{"/nowhere", fasthttp.StatusNotFound},
+	}
+	for _, test := range tests {
+		plain := serve(r, "GET", test.uri, "")
+		ctx := newRequest(test.uri)
+		ctx.Request.Header.Set("Accept", "application/json;q=0.9, application/msgpack")
+		r.Serve(ctx)
+		if ctx.Response.StatusCode() != test.status || plain.Response.StatusCode() != test.status {
+			t.Errorf("%s: status %d and %d, want %d", test.uri, ctx.Response.StatusCode(), plain.Response.StatusCode(), test.status)
+		}
+		if got := string(ctx.Response.Header.ContentType()); got != string(contentTypeMsgpack) {
+			t.Errorf("%s: content type %q", test.uri, got)
+		}
+		got, err := msgpackToJSON(ctx.Response.Body())
+		if err != nil {
+			t.Errorf("%s: %v", test.uri, err)
+			continue
+		}
+		if strings.Contains(test.uri, "/avg") {
+			// the float is not rounded the way JSON rounds it
+			continue
+		}
+		if !bytes.Equal(got, plain.Response.Body()) {
+			t.Errorf("%s: decodes to %s, want %s", test.uri, got, plain.Response.Body())
+		}
+	}
+}
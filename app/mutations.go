@@ -0,0 +1,458 @@
+package main
+
+import (
+	"log"
+
+	jlexer "github.com/mailru/easyjson/jlexer"
+)
+
+// createEntity validates body as a new entity and adds it to s. Parsing
+// happens outside the write lock; the checks against the store, the WAL
+// record and the mutation follow under it, in that order, so the log order
+// matches the order readers observe and nothing is visible that a restart
+// would lose.
+// An existing ID is rejected unless upsert is set, in which case the entity
+// is replaced and its visit adjacency carried over to the new value.
+func createEntity(s *Store, entity byte, body []byte, upsert bool) *Error {
+	record, err := decodeEntity(entity, body)
+	if err != nil {
+		return err
+	}
+	s = s.lockLive()
+	defer s.Unlock()
+	apply, err := prepareCreate(s, record, upsert)
+	if err != nil {
+		return err
+	}
+	if err := logCreate(record, upsert); err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// newEntity is a decoded and validated entity waiting to be added to the
+// store. Exactly one of user, location and visit is set.
+type newEntity struct {
+	entity   byte
+	body     []byte
+	user     *User
+	location *Location
+	visit    *Visit
+}
+
+func (e *newEntity) id() int {
+	switch e.entity {
+	case 'u':
+		return e.user.ID
+	case 'l':
+		return e.location.ID
+	}
+	return e.visit.ID
+}
+
+// decodeEntity parses body as an entity of the given kind and checks the
+// rules that do not depend on the store.
+func decodeEntity(entity byte, body []byte) (*newEntity, *Error) {
+	record := &newEntity{entity: entity, body: body}
+	switch entity {
+	case 'u':
+		record.user = new(User)
+		if err := record.user.UnmarshalJSON(body); err != nil {
+			return nil, errMalformedJSON
+		}
+		if err := record.user.Validate(); err != nil {
+			return nil, err
+		}
+	case 'l':
+		record.location = new(Location)
+		if err := record.location.UnmarshalJSON(body); err != nil {
+			return nil, errMalformedJSON
+		}
+		if err := record.location.Validate(); err != nil {
+			return nil, err
+		}
+	case 'v':
+		record.visit = new(Visit)
+		if err := record.visit.UnmarshalJSON(body); err != nil {
+			return nil, errMalformedJSON
+		}
+		if err := record.visit.Validate(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errRouteNotFound
+	}
+	return record, nil
+}
+
+// prepareCreate checks a decoded entity against s, which must be write
+// locked, and returns the mutation adding it. Nothing changes until the
+// returned function is called.
+func prepareCreate(s *Store, record *newEntity, upsert bool) (func(), *Error) {
+	switch record.entity {
+	case 'u':
+		user := record.user
+		old := s.User(user.ID)
+		if old != nil && !upsert {
+			return nil, errDuplicateID
+		}
+		return func() {
+			if old != nil {
+				// the location indexes bucket visits by gender, so each
+				// visit moves out under the old user and back in under
+				// the new
+				user.visits = old.visits
+				for _, entry := range user.visits.items {
+					if entry.visit != nil {
+						entry.visit.locationRef.visits.removeSorted(entry.visit)
+						entry.visit.userRef = user
+						entry.visit.locationRef.visits.insert(entry.visit)
+					}
+				}
+			}
+			s.SetUser(user)
+		}, nil
+	case 'l':
+		location := record.location
+		old := s.Location(location.ID)
+		if old != nil && !upsert {
+			return nil, errDuplicateID
+		}
+		return func() {
+			if old != nil {
+				location.visits = old.visits
+				location.visits.each(func(visit *Visit) {
+					visit.locationRef = location
+				})
+			}
+			s.SetLocation(location)
+		}, nil
+	}
+	visit := record.visit
+	location, user := s.Location(visit.Location), s.User(visit.User)
+	if location == nil {
+		return nil, unknownReference("location")
+	}
+	if user == nil {
+		return nil, unknownReference("user")
+	}
+	old := s.Visit(visit.ID)
+	if old != nil && !upsert {
+		return nil, errDuplicateID
+	}
+	return func() {
+		if old != nil {
+			old.userRef.visits.removeSorted(old)
+			old.locationRef.visits.removeSorted(old)
+		}
+		s.SetVisit(visit)
+		visit.locationRef, visit.userRef = location, user
+		user.visits.insert(visit)
+		location.visits.insert(visit)
+	}, nil
+}
+
+func logCreate(record *newEntity, upsert bool) *Error {
+	if upsert {
+		return logMutation(opUpsert, record.entity, 0, record.body)
+	}
+	return logMutation(opCreate, record.entity, 0, record.body)
+}
+
+// updateEntity applies a partial JSON update to an existing entity. Only the
+// keys present in body are changed; "id" and null values are rejected.
+func updateEntity(s *Store, entity byte, id int, body []byte) *Error {
+	s = s.lockLive()
+	defer s.Unlock()
+	apply, err := prepareUpdate(s, entity, id, body)
+	if err != nil {
+		return err
+	}
+	if err := logMutation(opUpdate, entity, id, body); err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareUpdate parses and checks an update against s, which must be write
+// locked, and returns the mutation applying it.
+func prepareUpdate(s *Store, entity byte, id int, body []byte) (func(), *Error) {
+	switch entity {
+	case 'u':
+		if user := s.User(id); user != nil {
+			birthDate, email, firstName, lastName, gender := false, false, false, false, false
+			update := new(User)
+			in := jlexer.Lexer{Data: body}
+			in.Delim('{')
+			for !in.IsDelim('}') {
+				key := in.UnsafeString()
+				in.WantColon()
+				if in.IsNull() {
+					return nil, nullField(string(key))
+				}
+				switch keyByte(key, 0) {
+				case 'i':
+					return nil, errIDImmutable
+				case 'b':
+					update.BirthDate = int(in.Int())
+					birthDate = true
+				case 'e':
+					update.Email = in.String()
+					email = true
+				case 'f':
+					update.FirstName = in.String()
+					firstName = true
+				case 'l':
+					update.LastName = in.String()
+					lastName = true
+				case 'g':
+					update.Gender = in.String()
+					gender = true
+				default:
+					in.SkipRecursive()
+				}
+				in.WantComma()
+			}
+			if !in.Ok() {
+				return nil, errMalformedJSON
+			}
+			return func() {
+				s.keepUser(id)
+				if birthDate {
+					user.BirthDate = update.BirthDate
+				}
+				if email {
+					user.Email = update.Email
+				}
+				if firstName {
+					user.FirstName = update.FirstName
+				}
+				if lastName {
+					user.LastName = update.LastName
+				}
+				if gender && user.Gender != update.Gender {
+					user.visits.each(func(visit *Visit) {
+						visit.locationRef.visits.removeSorted(visit)
+					})
+					user.Gender = update.Gender
+					user.visits.each(func(visit *Visit) {
+						visit.locationRef.visits.insert(visit)
+					})
+				}
+			}, nil
+		}
+		return nil, errNotFound
+	case 'l':
+		if location := s.Location(id); location != nil {
+			update := new(Location)
+			distance, place, country, city := false, false, false, false
+			in := jlexer.Lexer{Data: body}
+			in.Delim('{')
+			for !in.IsDelim('}') {
+				key := in.UnsafeString()
+				key0 := keyByte(key, 0)
+				in.WantColon()
+				if in.IsNull() {
+					return nil, nullField(string(key))
+				}
+				switch {
+				case key0 == 'i':
+					return nil, errIDImmutable
+				case key0 == 'd':
+					update.Distance = int(in.Int())
+					distance = true
+				case key0 == 'p':
+					update.Place = in.String()
+					place = true
+				case key0 == 'c' && keyByte(key, 1) == 'o':
+					update.Country = in.String()
+					country = true
+				case key0 == 'c' && keyByte(key, 1) == 'i':
+					update.City = in.String()
+					city = true
+				default:
+					in.SkipRecursive()
+				}
+				in.WantComma()
+			}
+			if !in.Ok() {
+				return nil, errMalformedJSON
+			}
+			return func() {
+				s.keepLocation(id)
+				if distance {
+					location.Distance = update.Distance
+				}
+				if place {
+					location.Place = update.Place
+				}
+				if country {
+					location.Country = update.Country
+				}
+				if city {
+					location.City = update.City
+				}
+			}, nil
+		}
+		return nil, errNotFound
+	case 'v':
+		if visit := s.Visit(id); visit != nil {
+			update := new(Visit)
+			location, user, visitedAt, mark := false, false, false, false
+			in := jlexer.Lexer{Data: body}
+			in.Delim('{')
+			for !in.IsDelim('}') {
+				key := in.UnsafeString()
+				in.WantColon()
+				if in.IsNull() {
+					return nil, nullField(string(key))
+				}
+				switch keyByte(key, 0) {
+				case 'i':
+					return nil, errIDImmutable
+				case 'l':
+					update.Location = int(in.Int())
+					location = visit.Location != update.Location
+				case 'u':
+					update.User = int(in.Int())
+					user = visit.User != update.User
+				case 'v':
+					update.VisitedAt = int(in.Int())
+					visitedAt = true
+				case 'm':
+					update.Mark = int(in.Int())
+					mark = true
+				default:
+					in.SkipRecursive()
+				}
+				in.WantComma()
+			}
+			if !in.Ok() {
+				return nil, errMalformedJSON
+			}
+			newLocation, newUser := visit.locationRef, visit.userRef
+			if location {
+				if newLocation = s.Location(update.Location); newLocation == nil {
+					return nil, unknownReference("location")
+				}
+			}
+			if user {
+				if newUser = s.User(update.User); newUser == nil {
+					return nil, unknownReference("user")
+				}
+			}
+			if !visitedAt {
+				update.VisitedAt = visit.VisitedAt
+			}
+			return func() {
+				s.keepVisit(id)
+				// both lists are ordered by visited_at and the location's is
+				// also bucketed by the user's gender, so any of the three
+				// changing means filing the visit again
+				if location || user || update.VisitedAt != visit.VisitedAt {
+					visit.userRef.visits.removeSorted(visit)
+					visit.locationRef.visits.removeSorted(visit)
+					visit.Location, visit.locationRef = newLocation.ID, newLocation
+					visit.User, visit.userRef = newUser.ID, newUser
+					visit.VisitedAt = update.VisitedAt
+					visit.userRef.visits.insert(visit)
+					visit.locationRef.visits.insert(visit)
+				}
+				if mark {
+					visit.Mark = update.Mark
+				}
+			}, nil
+		}
+		return nil, errNotFound
+	}
+	return nil, errRouteNotFound
+}
+
+// deleteEntity removes an entity. Deleting a user or location that still has
+// visits either fails with 409 or takes the visits with it, depending on
+// policy. The policy is logged with the record so replay does the same thing
+// regardless of the flags the service restarts with.
+func deleteEntity(s *Store, entity byte, id int, policy string) *Error {
+	s = s.lockLive()
+	defer s.Unlock()
+	apply, err := prepareDelete(s, entity, id, policy)
+	if err != nil {
+		return err
+	}
+	if err := logMutation(opDelete, entity, id, []byte(policy)); err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// prepareDelete checks a delete against s, which must be write locked, and
+// returns the mutation applying it.
+func prepareDelete(s *Store, entity byte, id int, policy string) (func(), *Error) {
+	switch entity {
+	case 'u':
+		user := s.User(id)
+		if user == nil {
+			return nil, errNotFound
+		}
+		if user.visits.len() > 0 && policy != deleteCascade {
+			return nil, errHasVisits
+		}
+		return func() {
+			user.visits.each(func(visit *Visit) {
+				visit.locationRef.visits.removeSorted(visit)
+				s.RemoveVisit(visit.ID)
+			})
+			user.visits.forget()
+			s.RemoveUser(id)
+		}, nil
+	case 'l':
+		location := s.Location(id)
+		if location == nil {
+			return nil, errNotFound
+		}
+		if location.visits.len() > 0 && policy != deleteCascade {
+			return nil, errHasVisits
+		}
+		return func() {
+			location.visits.each(func(visit *Visit) {
+				visit.userRef.visits.removeSorted(visit)
+				s.RemoveVisit(visit.ID)
+			})
+			location.visits.forget()
+			s.RemoveLocation(id)
+		}, nil
+	case 'v':
+		visit := s.Visit(id)
+		if visit == nil {
+			return nil, errNotFound
+		}
+		return func() {
+			visit.userRef.visits.removeSorted(visit)
+			visit.locationRef.visits.removeSorted(visit)
+			s.RemoveVisit(id)
+		}, nil
+	}
+	return nil, errRouteNotFound
+}
+
+// logMutation appends a checked mutation to the WAL before it is applied. It
+// must be called with the store write lock held.
+func logMutation(op, entity byte, id int, body []byte) *Error {
+	if err := wal.Append(op, entity, id, body); err != nil {
+		log.Println("wal:", err)
+		return errNotPersisted
+	}
+	return nil
+}
+
+// keyByte returns key[i], or 0 when key is too short, so that dispatching on
+// the leading bytes of a JSON key cannot panic on "" or "c".
+func keyByte(key string, i int) byte {
+	if i < len(key) {
+		return key[i]
+	}
+	return 0
+}
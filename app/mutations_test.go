@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateVisit(t *testing.T) {
+	s := newTestStore(t, 2, 2, 4)
+	tests := []struct {
+		name string
+		body string
+		want *Error
+	}{
+		{"ok", `{"id":5,"location":2,"user":1,"visited_at":100,"mark":3}`, nil},
+		{"missing user", `{"id":6,"location":2,"user":3,"visited_at":100,"mark":3}`, unknownReference("user")},
+		{"missing location", `{"id":6,"location":3,"user":1,"visited_at":100,"mark":3}`, unknownReference("location")},
+		{"duplicate id", `{"id":1,"location":2,"user":1,"visited_at":100,"mark":3}`, errDuplicateID},
+		{"zero id", `{"id":0,"location":2,"user":1,"visited_at":100,"mark":3}`, errIDOutOfRange},
+		{"negative id", `{"id":-6,"location":2,"user":1,"visited_at":100,"mark":3}`, errIDOutOfRange},
+		{"id above int32", `{"id":2147483648,"location":2,"user":1,"visited_at":100,"mark":3}`, errIDOutOfRange},
+		{"zero user", `{"id":6,"location":2,"user":0,"visited_at":100,"mark":3}`, outOfRange("user")},
+		{"negative user", `{"id":6,"location":2,"user":-1,"visited_at":100,"mark":3}`, outOfRange("user")},
+		{"user above int32", `{"id":6,"location":2,"user":2147483648,"visited_at":100,"mark":3}`, outOfRange("user")},
+		{"zero location", `{"id":6,"location":0,"user":1,"visited_at":100,"mark":3}`, outOfRange("location")},
+		{"negative location", `{"id":6,"location":-2,"user":1,"visited_at":100,"mark":3}`, outOfRange("location")},
+		{"location above int32", `{"id":6,"location":4294967297,"user":1,"visited_at":100,"mark":3}`, outOfRange("location")},
+		{"malformed json", `{"id":6,"location":2,"user":1,`, errMalformedJSON},
+		{"not an object", `[6,2,1]`, errMalformedJSON},
+		{"string id", `{"id":"6","location":2,"user":1,"visited_at":100,"mark":3}`, errMalformedJSON},
+	}
+	for _, test := range tests {
+		err := createEntity(s, 'v', []byte(test.body), false)
+		switch {
+		case test.want == nil && err != nil:
+			t.Errorf("%s: got %v", test.name, err)
+		case test.want != nil && (err == nil || err.Status != test.want.Status || err.Code != test.want.Code || err.Field != test.want.Field):
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+	if visit := s.Visit(5); visit == nil || visit.userRef != s.User(1) || visit.locationRef != s.Location(2) {
+		t.Error("visit 5 not linked to user 1 and location 2")
+	}
+	if s.Visit(6) != nil {
+		t.Error("a rejected visit was stored")
+	}
+	checkVisitLists(t, s)
+}
+
+// TestUnloggedMutationsNotApplied checks that a mutation the WAL refused is
+// not left visible in the store.
+func TestUnloggedMutationsNotApplied(t *testing.T) {
+	s := newTestStore(t, 2, 2, 4)
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "wal"), syncNever, 0, 0, replayWAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.file.Close()
+	wal = w
+	defer func() { wal = nil }()
+
+	if err := createEntity(s, 'v', []byte(`{"id":5,"location":1,"user":1,"visited_at":1,"mark":1}`), false); err != errNotPersisted {
+		t.Errorf("create: got %v, want %v", err, errNotPersisted)
+	}
+	if s.Visit(5) != nil || s.User(1).visits.len() != 2 {
+		t.Error("create was applied")
+	}
+	if err := updateEntity(s, 'v', 1, []byte(`{"visited_at":99999,"mark":5}`)); err != errNotPersisted {
+		t.Errorf("update: got %v, want %v", err, errNotPersisted)
+	}
+	if visit := s.Visit(1); visit.VisitedAt == 99999 || visit.Mark == 5 {
+		t.Error("update was applied")
+	}
+	if err := deleteEntity(s, 'u', 1, deleteCascade); err != errNotPersisted {
+		t.Errorf("delete: got %v, want %v", err, errNotPersisted)
+	}
+	if s.User(1) == nil || s.Visit(1) == nil {
+		t.Error("delete was applied")
+	}
+	checkVisitLists(t, s)
+}
+
+// TestUpsertRelinksVisits replaces a user, a location and a visit that all
+// have visits attached and checks the lists and what Visits and Avg serve
+// from them after each.
+func TestUpsertRelinksVisits(t *testing.T) {
+	s := newTestStore(t, 4, 3, 36)
+	upserts := []struct {
+		name   string
+		entity byte
+		body   string
+	}{
+		{"user changing gender", 'u', `{"id":2,"email":"up@x.ru","first_name":"U","last_name":"P","gender":"m","birth_date":0}`},
+		{"location", 'l', `{"id":1,"place":"Dock","country":"Peru","city":"Lima","distance":1}`},
+		{"visit changing user, location and date", 'v', `{"id":5,"location":3,"user":4,"visited_at":1,"mark":5}`},
+	}
+	for _, upsert := range upserts {
+		if err := createEntity(s, upsert.entity, []byte(upsert.body), true); err != nil {
+			t.Fatalf("%s: %v", upsert.name, err)
+		}
+		checkVisitLists(t, s)
+		for id := 1; id <= 4; id++ {
+			got := getVisits(t, id, "")
+			if want := wantVisits(s, id, anyVisit); fmt.Sprint(got.Visits) != fmt.Sprint(want) {
+				t.Errorf("%s: user %d visits %v, want %v", upsert.name, id, got.Visits, want)
+			}
+		}
+		for id := 1; id <= 3; id++ {
+			for _, gender := range []string{"f", "m"} {
+				got := getAvg(t, id, "gender="+gender)
+				want := wantAvg(s, id, func(visit *Visit) bool {
+					return s.User(visit.User).Gender == gender
+				})
+				if got != want {
+					t.Errorf("%s: location %d avg for %s is %v, want %v", upsert.name, id, gender, got, want)
+				}
+			}
+		}
+	}
+	if s.User(2).visits.len() == 0 || s.Location(1).visits.len() == 0 {
+		t.Error("the upserted user and location were meant to have visits")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// reloading is set for the whole of a reload, so at most one runs at a time.
+// reloadPath is the data the next SIGHUP loads: the startup data path, or
+// whatever was last swapped in, here or in the WAL replayed at startup.
+// Snapshots do not record it, so booting from one taken after a reload
+// falls back to the startup path. Only a running reload, or replaying one,
+// touches it.
+var reloading int32
+var reloadPath string
+
+var errReloadRunning = &Error{fasthttp.StatusConflict, "reload_in_progress", "", "a reload is already running"}
+
+// startReload loads dataPath, or the last reloaded path when it is empty,
+// into a fresh store in the background and swaps it in once complete.
+// Requests keep being served from the current store meanwhile; writes made
+// to it during the load are discarded with it.
+func startReload(dataPath string) *Error {
+	if !atomic.CompareAndSwapInt32(&reloading, 0, 1) {
+		return errReloadRunning
+	}
+	if dataPath == "" {
+		dataPath = reloadPath
+	}
+	go func() {
+		defer atomic.StoreInt32(&reloading, 0)
+		start := time.Now()
+		if err := reload(dataPath); err != nil {
+			log.Printf("reload: %s: %v", dataPath, err)
+			return
+		}
+		log.Printf("reload: swapped in %s after %v", dataPath, time.Since(start))
+	}()
+	return nil
+}
+
+// reload swaps in the data at dataPath. Once the swap is in the WAL the
+// reload has happened: a restart replays it, so a snapshot of the new store
+// failing afterwards is only logged.
+func reload(dataPath string) error {
+	// the collector is off while serving; the new dataset is as large as
+	// the live one and the old one has to go once the swap is done
+	debug.SetGCPercent(50)
+	defer func() {
+		runtime.GC()
+		debug.SetGCPercent(-1)
+	}()
+
+	next, err := loadReplacement(dataPath)
+	if err != nil {
+		return err
+	}
+	if err := replaceStore(next, dataPath); err != nil {
+		next.forgetVisitLists()
+		return err
+	}
+	reloadPath = dataPath
+	if *snapshotDir != "" {
+		name, err := WriteSnapshot(next, *snapshotDir)
+		if err != nil {
+			log.Printf("reload: swapped in %s, but its snapshot failed: %v", dataPath, err)
+			return nil
+		}
+		log.Printf("reload: wrote %s", name)
+	}
+	return nil
+}
+
+// replayReload repeats a reload found in the WAL, so the records after it
+// land on the data they were made against.
+func replayReload(dataPath string) error {
+	next, err := loadReplacement(dataPath)
+	if err != nil {
+		return err
+	}
+	if err := replaceStore(next, dataPath); err != nil {
+		next.forgetVisitLists()
+		return err
+	}
+	reloadPath = dataPath
+	return nil
+}
+
+// loadReplacement loads dataPath into a store that is not live yet.
+func loadReplacement(dataPath string) (*Store, error) {
+	next := NewStore(*usersCap, *locationsCap, *visitsCap)
+	report, err := loadData(next, dataPath)
+	if err != nil {
+		next.forgetVisitLists()
+		return nil, err
+	}
+	report.summarize()
+	if *strictLoad && len(report.issues) > 0 {
+		next.forgetVisitLists()
+		return nil, errors.New("strict mode, keeping the current data")
+	}
+	return next, nil
+}
+
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := startReload(""); err != nil {
+			log.Println("reload:", err)
+		}
+	}
+}
+
+// Reload starts loading the data at ?path=, or the last loaded data when it
+// is not given, and answers 202 without waiting for it to finish.
+func Reload(ctx *fasthttp.RequestCtx) []byte {
+	if err := startReload(string(ctx.QueryArgs().Peek("path"))); err != nil {
+		return fail(ctx, err)
+	}
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+	return emptyJSON
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+// TestReloadReplay swaps datasets with writes on both sides of the swap,
+// some of them through a handle to the replaced store, and checks a restart
+// ends up with the same data whether it boots from the startup data and
+// replays the reload or boots from the snapshot written after it.
+func TestReloadReplay(t *testing.T) {
+	gc := debug.SetGCPercent(100)
+	t.Cleanup(func() {
+		debug.SetGCPercent(gc)
+		*snapshotDir = ""
+		reloadPath = ""
+	})
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.zip"), filepath.Join(dir, "b.zip")
+	writeZip(t, a, "", testDataset(20, 8, 100, 30), "1500000000\n")
+	writeZip(t, b, "", testDataset(12, 5, 60, 30), "1510000000\n")
+
+	for _, snapshots := range []bool{false, true} {
+		walPath := filepath.Join(t.TempDir(), "wal")
+		*snapshotDir = ""
+		if snapshots {
+			*snapshotDir = t.TempDir()
+		}
+		// boot starts the way main does, from the newest snapshot or else
+		// the startup data, and replays the WAL over it
+		boot := func() *Store {
+			s := NewStore(0, 0, 0)
+			live.Store(s)
+			reloadPath = a
+			var lsn uint64
+			ok := false
+			if snapshots {
+				lsn, ok = LoadSnapshot(s, *snapshotDir)
+			}
+			if !ok {
+				if _, err := loadData(s, a); err != nil {
+					t.Fatal(err)
+				}
+			}
+			openTestWAL(t, walPath, lsn)
+			return currentStore()
+		}
+
+		old := boot()
+		mustCreate(t, old, 'u', `{"id":100,"email":"old@x.ru","first_name":"O","last_name":"D","gender":"m","birth_date":0}`)
+		if err := reload(b); err != nil {
+			t.Fatal(err)
+		}
+		debug.SetGCPercent(100)
+		next := currentStore()
+		if next == old || reloadPath != b {
+			t.Fatalf("snapshots %v: reload did not swap in %s", snapshots, b)
+		}
+		if next.User(100) != nil {
+			t.Errorf("snapshots %v: a write to the replaced store reached the new one", snapshots)
+		}
+		// a writer still holding the old store lands on the new one
+		mustCreate(t, old, 'u', `{"id":101,"email":"late@x.ru","first_name":"L","last_name":"T","gender":"f","birth_date":0}`)
+		if next.User(101) == nil {
+			t.Errorf("snapshots %v: a write through the replaced store was lost", snapshots)
+		}
+		if err := updateEntity(next, 'l', 2, []byte(`{"distance":42}`)); err != nil {
+			t.Fatal(err)
+		}
+		closeTestWAL(wal)
+
+		replayed := boot()
+		// a snapshot does not know which data it came from
+		if !snapshots && reloadPath != b {
+			t.Errorf("snapshots %v: reload path %q after a restart, want %q", snapshots, reloadPath, b)
+		}
+		checkSameStore(t, replayed, next)
+	}
+}
+
+// TestReloadNotLogged checks a swap the WAL refuses leaves the live store
+// in place.
+func TestReloadNotLogged(t *testing.T) {
+	s := newTestStore(t, 2, 2, 4)
+	w := openTestWAL(t, filepath.Join(t.TempDir(), "wal"), 0)
+	w.file.Close()
+	next := NewStore(0, 0, 0)
+	if err := replaceStore(next, os.DevNull); err == nil {
+		t.Fatal("swapped in a store without logging it")
+	}
+	if currentStore() != s || s.successor != nil {
+		t.Error("a failed swap replaced the live store")
+	}
+}
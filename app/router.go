@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const maxParams = 2
+
+var doubleSlash = []byte("//")
+
+// Params holds the values of a matched route's ":name" segments in the
+// order they appear in the pattern. The slices point into the request path.
+type Params [maxParams][]byte
+
+type routeHandler func(ctx *fasthttp.RequestCtx, ps Params) []byte
+
+type route struct {
+	method   string
+	segments []string
+	metric   int
+	handler  routeHandler
+}
+
+// Router matches request paths exactly against a table of patterns such as
+// "/users/:id/visits". Routes are tried in registration order, so static
+// routes like "/users/new" must be registered before "/users/:id" to win.
+// Matching does not allocate.
+type Router struct {
+	routes []route
+}
+
+// Handle registers h for method and pattern. metric selects the bucket the
+// request is counted in on /metrics.
+func (r *Router) Handle(method, pattern string, metric int, h routeHandler) {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	params := 0
+	for _, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			params++
+		}
+	}
+	if params > maxParams {
+		panic("router: too many parameters in " + pattern)
+	}
+	r.routes = append(r.routes, route{method, segments, metric, h})
+}
+
+func (r *Router) GET(pattern string, metric int, h routeHandler) {
+	r.Handle("GET", pattern, metric, h)
+}
+
+func (r *Router) POST(pattern string, metric int, h routeHandler) {
+	r.Handle("POST", pattern, metric, h)
+}
+
+func (r *Router) DELETE(pattern string, metric int, h routeHandler) {
+	r.Handle("DELETE", pattern, metric, h)
+}
+
+// Serve dispatches ctx to the first route matching both path and method.
+// A path that matches only under other methods gets 405 with an Allow
+// header, anything else 404.
+func (r *Router) Serve(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	path, method := ctx.Path(), ctx.Method()
+	// Path has repeated slashes collapsed, which would let "/users//visits"
+	// through as "/users/visits"; the path as sent must have no empty
+	// segments either
+	if bytes.Contains(ctx.URI().PathOriginal(), doubleSlash) {
+		path = nil
+	}
+	pathMatched := false
+	var ps Params
+	for i := range r.routes {
+		rt := &r.routes[i]
+		// routes tried before may have filled in parameters
+		ps = Params{}
+		if !rt.match(path, &ps) {
+			continue
+		}
+		if string(method) != rt.method {
+			pathMatched = true
+			continue
+		}
+		writeJSON(ctx, rt.handler(ctx, ps))
+		observe(rt.metric, ctx.Response.StatusCode(), time.Since(start))
+		return
+	}
+
+	if pathMatched {
+		ctx.Response.Header.Set("Allow", r.allowed(path))
+		writeJSON(ctx, fail(ctx, errMethodNotAllowed))
+	} else {
+		writeJSON(ctx, fail(ctx, errRouteNotFound))
+	}
+	observe(routeUnknown, ctx.Response.StatusCode(), time.Since(start))
+}
+
+func (r *Router) allowed(path []byte) string {
+	var ps Params
+	methods := make([]string, 0, 3)
+	for i := range r.routes {
+		rt := &r.routes[i]
+		if rt.match(path, &ps) && !containsString(methods, rt.method) {
+			methods = append(methods, rt.method)
+		}
+	}
+	return strings.Join(methods, ", ")
+}
+
+// match reports whether path has exactly the route's segments, storing the
+// parameter values in ps. Empty segments never match, so "/users//visits"
+// and "/users/1/" are rejected.
+func (rt *route) match(path []byte, ps *Params) bool {
+	if len(path) == 0 || path[0] != '/' {
+		return false
+	}
+	path = path[1:]
+	n := 0
+	for i, segment := range rt.segments {
+		part := path
+		last := i == len(rt.segments)-1
+		if j := bytes.IndexByte(path, '/'); j >= 0 {
+			if last {
+				return false
+			}
+			part, path = path[:j], path[j+1:]
+		} else if !last {
+			return false
+		}
+		if len(part) == 0 {
+			return false
+		}
+		if segment[0] == ':' {
+			ps[n] = part
+			n++
+		} else if string(part) != segment {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newRecordingRouter registers patterns shaped like the service's, each
+// answering with the pattern it was registered under and its parameters.
+func newRecordingRouter() *Router {
+	r := new(Router)
+	record := func(pattern string) routeHandler {
+		return func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+			return []byte(pattern + " " + string(ps[0]) + " " + string(ps[1]))
+		}
+	}
+	for _, pattern := range []string{"/users/:id", "/locations/:id", "/users/:id/visits", "/locations/:id/avg"} {
+		r.GET(pattern, routeEntity, record("GET "+pattern))
+	}
+	for _, pattern := range []string{"/locations/new", "/users/new", "/users/:id", "/:kind/:id/move"} {
+		r.POST(pattern, routeCreate, record("POST "+pattern))
+	}
+	r.DELETE("/users/:id", routeDelete, record("DELETE /users/:id"))
+	return r
+}
+
+func TestRouterServe(t *testing.T) {
+	r := newRecordingRouter()
+	tests := []struct {
+		method, path string
+		status       int
+		body, allow  string
+	}{
+		{"GET", "/users/1", 200, "GET /users/:id 1 ", ""},
+		{"GET", "/users/1/visits", 200, "GET /users/:id/visits 1 ", ""},
+		{"GET", "/locations/7/avg", 200, "GET /locations/:id/avg 7 ", ""},
+		{"POST", "/users/new", 200, "POST /users/new  ", ""},
+		{"POST", "/locations/new", 200, "POST /locations/new  ", ""},
+		{"POST", "/users/5", 200, "POST /users/:id 5 ", ""},
+		{"POST", "/visits/5/move", 200, "POST /:kind/:id/move visits 5", ""},
+		{"GET", "/users/new", 200, "GET /users/:id new ", ""},
+		{"GET", "/visists/1", 404, "", ""},
+		{"GET", "/uxyz/5", 404, "", ""},
+		{"GET", "/locations/1/abc", 404, "", ""},
+		{"GET", "/users//visits", 404, "", ""},
+		{"GET", "/users/1//visits", 404, "", ""},
+		{"GET", "/users/1/", 404, "", ""},
+		{"GET", "/users/1/visits/", 404, "", ""},
+		{"GET", "/users", 404, "", ""},
+		{"GET", "/", 404, "", ""},
+		{"PUT", "/users/1", 405, "", "GET, POST, DELETE"},
+		{"DELETE", "/users/1/visits", 405, "", "GET"},
+		{"POST", "/locations/1/avg", 405, "", "GET"},
+	}
+	for _, test := range tests {
+		ctx := newRequest(test.path)
+		ctx.Request.Header.SetMethod(test.method)
+		r.Serve(ctx)
+		if status := ctx.Response.StatusCode(); status != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, status, test.status)
+			continue
+		}
+		if test.status == 200 {
+			if body := string(ctx.Response.Body()); body != test.body {
+				t.Errorf("%s %s: routed to %q, want %q", test.method, test.path, body, test.body)
+			}
+		}
+		if allow := string(ctx.Response.Header.Peek("Allow")); allow != test.allow {
+			t.Errorf("%s %s: Allow %q, want %q", test.method, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		match         bool
+		ps            Params
+	}{
+		{"/users/:id", "/users/12", true, Params{[]byte("12")}},
+		{"/users/:id/visits", "/users/12/visits", true, Params{[]byte("12")}},
+		{"/users/new", "/users/new", true, Params{}},
+		{"/users/new", "/users/newer", false, Params{}},
+		{"/users/:id", "/users/", false, Params{}},
+		{"/users/:id", "/users/1/", false, Params{}},
+		{"/users/:id", "/users", false, Params{}},
+		{"/users/:id", "users/1", false, Params{}},
+		{"/users/:id", "", false, Params{}},
+		{"/users/:id/visits", "/users//visits", false, Params{}},
+		{"/users/:id/visits", "/users/1/visit", false, Params{}},
+		{"/:kind/:id", "/visits/3", true, Params{[]byte("visits"), []byte("3")}},
+	}
+	for _, test := range tests {
+		r := new(Router)
+		r.GET(test.pattern, routeEntity, nil)
+		var ps Params
+		if got := r.routes[0].match([]byte(test.path), &ps); got != test.match {
+			t.Errorf("%s against %q: match %v, want %v", test.pattern, test.path, got, test.match)
+			continue
+		}
+		if test.match && (string(ps[0]) != string(test.ps[0]) || string(ps[1]) != string(test.ps[1])) {
+			t.Errorf("%s against %q: params %q, want %q", test.pattern, test.path, ps, test.ps)
+		}
+	}
+}
+
+// TestServiceRoutes checks the precedence and Allow headers of the routes
+// the service actually registers.
+func TestServiceRoutes(t *testing.T) {
+	newTestStore(t, 2, 2, 4)
+	r := newRouter()
+
+	ctx := newRequest("/users/1")
+	ctx.Request.Header.SetMethod("PUT")
+	r.Serve(ctx)
+	if status, allow := ctx.Response.StatusCode(), string(ctx.Response.Header.Peek("Allow")); status != 405 || allow != "GET, POST, DELETE" {
+		t.Errorf("PUT /users/1: %d with Allow %q", status, allow)
+	}
+
+	// /users/new must create rather than update a user with id "new"
+	ctx = newRequest("/users/new")
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetBodyString(`{"id":3,"email":"a@b.ru","first_name":"A","last_name":"B","gender":"f","birth_date":0}`)
+	r.Serve(ctx)
+	if status := ctx.Response.StatusCode(); status != 200 || currentStore().User(3) == nil {
+		t.Errorf("POST /users/new: %d %s", status, ctx.Response.Body())
+	}
+
+	ctx = newRequest("/users/new")
+	r.Serve(ctx)
+	if status := ctx.Response.StatusCode(); status != 404 {
+		t.Errorf("GET /users/new: %d, want 404", status)
+	}
+}
@@ -1,176 +1,277 @@
 package main
 
 import (
+	"encoding/base64"
 	"math"
-	"sort"
 	"strconv"
+	"strings"
 
-	jlexer "github.com/mailru/easyjson/jlexer"
 	"github.com/valyala/fasthttp"
 )
 
-func EntityById(ctx *fasthttp.RequestCtx, entity byte, idStr string) []byte {
-	id, err := strconv.ParseInt(idStr, 10, 32)
-	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
+func newRouter() *Router {
+	r := new(Router)
+	r.GET("/metrics", routeMetrics, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		Metrics(ctx)
 		return nil
+	})
+	if *adminEnabled {
+		r.GET("/admin/clock", routeAdmin, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+			return ClockNow(ctx)
+		})
+		r.POST("/admin/clock", routeAdmin, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+			return SetClock(ctx)
+		})
+		r.DELETE("/admin/clock", routeAdmin, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+			clock.Reset()
+			return ClockNow(ctx)
+		})
+		r.POST("/admin/reload", routeAdmin, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+			return Reload(ctx)
+		})
 	}
+	r.GET("/users/:id", routeEntity, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return EntityById(ctx, 'u', ps[0])
+	})
+	r.GET("/locations/:id", routeEntity, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return EntityById(ctx, 'l', ps[0])
+	})
+	r.GET("/visits/:id", routeEntity, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return EntityById(ctx, 'v', ps[0])
+	})
+	r.GET("/users/:id/visits", routeVisits, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Visits(ctx, ps[0])
+	})
+	r.GET("/locations/:id/avg", routeAvg, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Avg(ctx, ps[0])
+	})
+	r.GET("/export/users", routeExport, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Export(ctx, 'u')
+	})
+	r.GET("/export/locations", routeExport, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Export(ctx, 'l')
+	})
+	r.GET("/export/visits", routeExport, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Export(ctx, 'v')
+	})
+	r.POST("/users/new", routeCreate, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Create(ctx, 'u')
+	})
+	r.POST("/locations/new", routeCreate, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Create(ctx, 'l')
+	})
+	r.POST("/visits/new", routeCreate, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Create(ctx, 'v')
+	})
+	r.POST("/import", routeImport, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Import(ctx)
+	})
+	r.POST("/users/:id", routeUpdate, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Update(ctx, 'u', ps[0])
+	})
+	r.POST("/locations/:id", routeUpdate, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Update(ctx, 'l', ps[0])
+	})
+	r.POST("/visits/:id", routeUpdate, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Update(ctx, 'v', ps[0])
+	})
+	r.DELETE("/users/:id", routeDelete, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Delete(ctx, 'u', ps[0])
+	})
+	r.DELETE("/locations/:id", routeDelete, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Delete(ctx, 'l', ps[0])
+	})
+	r.DELETE("/visits/:id", routeDelete, func(ctx *fasthttp.RequestCtx, ps Params) []byte {
+		return Delete(ctx, 'v', ps[0])
+	})
+	return r
+}
+
+// parseID parses a path parameter as an entity ID without allocating.
+func parseID(b []byte) (int, bool) {
+	id, err := fasthttp.ParseUint(b)
+	return id, err == nil
+}
+
+func EntityById(ctx *fasthttp.RequestCtx, entity byte, idBytes []byte) []byte {
+	id, ok := parseID(idBytes)
+	if !ok {
+		return fail(ctx, errBadID)
+	}
+	s := currentStore()
+	s.RLock()
+	defer s.RUnlock()
 	switch entity {
 	case 'u':
-		if id < int64(len(users)) && users[id] != nil {
-			data, _ := users[id].MarshalJSON()
-			return data
+		if user := s.User(id); user != nil {
+			return encode(ctx, user)
 		}
 	case 'l':
-		if id < int64(len(locations)) && locations[id] != nil {
-			data, _ := locations[id].MarshalJSON()
-			return data
+		if location := s.Location(id); location != nil {
+			return encode(ctx, location)
 		}
 	case 'v':
-		if id < int64(len(visits)) && visits[id] != nil {
-			data, _ := visits[id].MarshalJSON()
-			return data
+		if visit := s.Visit(id); visit != nil {
+			return encode(ctx, visit)
 		}
 	}
-	ctx.SetStatusCode(fasthttp.StatusNotFound)
-	return nil
+	return fail(ctx, errNotFound)
 }
 
-type visitPredicate func(*Visit) bool
-
-func Visits(ctx *fasthttp.RequestCtx, idStr string) []byte {
-	id, err := strconv.ParseInt(idStr, 10, 32)
-	if err != nil || id > int64(len(users)) || users[id] == nil {
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
-		return nil
+func Visits(ctx *fasthttp.RequestCtx, idBytes []byte) []byte {
+	id, ok := parseID(idBytes)
+	if !ok {
+		return fail(ctx, errBadID)
+	}
+	s := currentStore()
+	s.RLock()
+	defer s.RUnlock()
+	user := s.User(id)
+	if user == nil {
+		return fail(ctx, errNotFound)
 	}
-	user, filters := users[id], make([]visitPredicate, 0)
 	args := ctx.QueryArgs()
-	if fromDate, err := args.GetUint("fromDate"); err == nil {
-		filters = append(filters, func(x *Visit) bool {
-			return x.VisitedAt > fromDate
-		})
-	} else if err != fasthttp.ErrNoArgValue {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
+	filter := newVisitFilter(args)
+	filter.locations()
+	filter.marks()
+	if filter.err != nil {
+		return fail(ctx, filter.err)
 	}
-	if toDate, err := args.GetUint("toDate"); err == nil {
-		filters = append(filters, func(x *Visit) bool {
-			return x.VisitedAt < toDate
-		})
+	limit := 0
+	if v, err := args.GetUint("limit"); err == nil && v > 0 {
+		limit = v
 	} else if err != fasthttp.ErrNoArgValue {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
+		return fail(ctx, errInvalidLimit)
 	}
-	country := string(args.PeekBytes(countryBytes))
-	if len(country) > 0 {
-		filters = append(filters, func(x *Visit) bool {
-			return x.locationRef.Country == country
-		})
-	}
-	if toDistance, err := args.GetUint("toDistance"); err == nil {
-		filters = append(filters, func(x *Visit) bool {
-			return x.locationRef.Distance < toDistance
-		})
-	} else if err != fasthttp.ErrNoArgValue {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
+	descending := false
+	switch string(args.Peek("order")) {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		return fail(ctx, errInvalidOrder)
 	}
-	resultVisits := make([]VisitResult, 0)
-	for _, visit := range user.visits {
-		if visit == nil {
-			continue
+	// the list is ordered by visited_at, so the date range is a slice of
+	// it and the result needs no sorting in either direction
+	lo, hi := filter.span(&user.visits)
+	if cursor := args.Peek("cursor"); len(cursor) > 0 {
+		at, visitID, ok := parseCursor(cursor)
+		if !ok {
+			return fail(ctx, errInvalidCursor)
 		}
-		satisfy := true
-		for _, fn := range filters {
-			if !fn(visit) {
-				satisfy = false
-				break
+		if descending {
+			if i := user.visits.resumeBefore(at, visitID); i < hi {
+				hi = i
 			}
+		} else if i := user.visits.resume(at, visitID); i > lo {
+			lo = i
 		}
-		if satisfy {
-			resultVisits = append(resultVisits, VisitResult{
-				Place:     visit.locationRef.Place,
-				Mark:      visit.Mark,
-				VisitedAt: visit.VisitedAt,
-			})
+		if hi < lo {
+			hi = lo
 		}
 	}
-	sort.Slice(resultVisits, func(i, j int) bool {
-		return resultVisits[i].VisitedAt < resultVisits[j].VisitedAt
-	})
-	bytes, _ := VisitsResult{Visits: resultVisits}.MarshalJSON()
-	return bytes
+	// a page ends at the limit, and only gets a next cursor if another
+	// match follows; the cursor names the last visit returned, so pages
+	// stay in order even as visits are added or removed between requests
+	result := VisitsResult{Visits: make([]VisitResult, 0)}
+	var last *Visit
+	for n := 0; n < hi-lo; n++ {
+		i := lo + n
+		if descending {
+			i = hi - 1 - n
+		}
+		visit := user.visits.items[i].visit
+		if visit == nil || !filter.match(visit) {
+			continue
+		}
+		if limit > 0 && len(result.Visits) == limit {
+			result.Next = formatCursor(last.VisitedAt, last.ID)
+			break
+		}
+		result.Visits = append(result.Visits, VisitResult{
+			Place:     visit.locationRef.Place,
+			Mark:      visit.Mark,
+			VisitedAt: visit.VisitedAt,
+		})
+		last = visit
+	}
+	return encode(ctx, result)
 }
 
-func Avg(ctx *fasthttp.RequestCtx, idStr string) []byte {
-	id, err := strconv.ParseInt(idStr, 10, 32)
-	if err != nil || id > int64(len(locations)) || locations[id] == nil {
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
-		return nil
+// Cursors are opaque to clients: the visited_at and ID of the last visit of
+// a page, base64 encoded.
+func formatCursor(at, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(at) + "." + strconv.Itoa(id)))
+}
+
+func parseCursor(cursor []byte) (int, int, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(string(cursor))
+	if err != nil {
+		return 0, 0, false
 	}
-	location, filters := locations[id], make([]visitPredicate, 0)
-	args := ctx.QueryArgs()
-	if fromDate, err := args.GetUint("fromDate"); err == nil {
-		filters = append(filters, func(x *Visit) bool {
-			return x.VisitedAt > fromDate
-		})
-	} else if err != fasthttp.ErrNoArgValue {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
+	parts := strings.SplitN(string(raw), ".", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
 	}
-	if toDate, err := args.GetUint("toDate"); err == nil {
-		filters = append(filters, func(x *Visit) bool {
-			return x.VisitedAt < toDate
-		})
-	} else if err != fasthttp.ErrNoArgValue {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
+	at, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return at, id, true
+}
+
+func Avg(ctx *fasthttp.RequestCtx, idBytes []byte) []byte {
+	id, ok := parseID(idBytes)
+	if !ok {
+		return fail(ctx, errBadID)
+	}
+	s := currentStore()
+	s.RLock()
+	defer s.RUnlock()
+	location := s.Location(id)
+	if location == nil {
+		return fail(ctx, errNotFound)
 	}
-	gender := string(args.Peek("gender"))
+	// date and gender filters select ranges of the location's per-gender
+	// ordered buckets; only the age filters are checked visit by visit
+	args := ctx.QueryArgs()
+	filter := newVisitFilter(args)
+	if filter.err != nil {
+		return fail(ctx, filter.err)
+	}
+	buckets := location.visits[:]
+	gender := args.Peek("gender")
 	if len(gender) > 0 {
-		if gender != "f" && gender != "m" {
-			ctx.SetStatusCode(fasthttp.StatusBadRequest)
-			return nil
+		switch string(gender) {
+		case "f":
+			buckets = location.visits[genderFemale : genderFemale+1]
+		case "m":
+			buckets = location.visits[genderMale : genderMale+1]
+		default:
+			return fail(ctx, errUnknownGender)
 		}
-		filters = append(filters, func(x *Visit) bool {
-			return x.userRef.Gender == gender
-		})
 	}
-	if fromAge, err := args.GetUint("fromAge"); err == nil {
-		filters = append(filters, func(x *Visit) bool {
-			return x.userRef.Age >= fromAge
-		})
-	} else if err != fasthttp.ErrNoArgValue {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
-	}
-	if toAge, err := args.GetUint("toAge"); err == nil {
-		filters = append(filters, func(x *Visit) bool {
-			return x.userRef.Age < toAge
-		})
-	} else if err != fasthttp.ErrNoArgValue {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
+	filter.ages(clock.Now())
+	if filter.err != nil {
+		return fail(ctx, filter.err)
 	}
 
 	var count = 0
 	var sum = 0
-	for _, visit := range location.visits {
-		if visit == nil {
-			continue
-		}
-		satisfy := true
-		for _, fn := range filters {
-			if !fn(visit) {
-				satisfy = false
-				break
+	for i := range buckets {
+		bucket := &buckets[i]
+		lo, hi := filter.span(bucket)
+		for ; lo < hi; lo++ {
+			visit := bucket.items[lo].visit
+			if visit != nil && filter.match(visit) {
+				count++
+				sum += visit.Mark
 			}
 		}
-		if satisfy {
-			count++
-			sum += visit.Mark
-		}
 	}
 	avg := 0.0
 	if count > 0 {
@@ -179,8 +280,7 @@ func Avg(ctx *fasthttp.RequestCtx, idStr string) []byte {
 
 	res := math.Pow(10, float64(5))
 	avg = float64(round(avg*res)) / res
-	bytes, _ := AvgResult{Avg: avg}.MarshalJSON()
-	return bytes
+	return encode(ctx, AvgResult{Avg: avg})
 }
 
 func round(num float64) int {
@@ -188,254 +288,58 @@ func round(num float64) int {
 }
 
 func Create(ctx *fasthttp.RequestCtx, entity byte) []byte {
-	switch entity {
-	case 'u':
-		user := new(User)
-		err := user.UnmarshalJSON(ctx.PostBody())
-		if err != nil || !user.IsValid() {
-			ctx.SetStatusCode(fasthttp.StatusBadRequest)
-			return nil
-		}
-		user.visits = make([]*Visit, 10)
-		users[user.ID] = user
-	case 'l':
-		location := new(Location)
-		err := location.UnmarshalJSON(ctx.PostBody())
-		if err != nil || !location.IsValid() {
-			ctx.SetStatusCode(fasthttp.StatusBadRequest)
-			return nil
-		}
-		location.visits = make([]*Visit, 10)
-		locations[location.ID] = location
-	case 'v':
-		visit := new(Visit)
-		err := visit.UnmarshalJSON(ctx.PostBody())
-		if err != nil || !visit.IsValid() {
-			ctx.SetStatusCode(fasthttp.StatusBadRequest)
-			return nil
-		}
-		visits[visit.ID] = visit
-		location := locations[visit.Location]
-		location.visits = append(location.visits, visit)
-		visit.locationRef = location
-		user := users[visit.User]
-		user.visits = append(user.visits, visit)
-		visit.userRef = user
+	upsert := ctx.QueryArgs().GetBool("upsert")
+	body, err := requestBody(ctx)
+	if err != nil {
+		return fail(ctx, err)
 	}
-
-	return emptyJSON
+	if err := createEntity(currentStore(), entity, body, upsert); err != nil {
+		return fail(ctx, err)
+	}
+	return encode(ctx, emptyObject{})
 }
 
-func Update(ctx *fasthttp.RequestCtx, entity byte, idStr string) []byte {
-	id, err := strconv.ParseInt(idStr, 10, 32)
+func Update(ctx *fasthttp.RequestCtx, entity byte, idBytes []byte) []byte {
+	id, ok := parseID(idBytes)
+	if !ok {
+		return fail(ctx, errInvalidID)
+	}
+	body, err := requestBody(ctx)
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return nil
+		return fail(ctx, err)
 	}
-	switch entity {
-	case 'u':
-		if id < int64(len(users)) && users[id] != nil {
-			user := users[id]
-			birthDate, email, firstName, lastName, gender := false, false, false, false, false
-			update := new(User)
-			in := jlexer.Lexer{Data: ctx.PostBody()}
-			in.Delim('{')
-			for !in.IsDelim('}') {
-				key := in.UnsafeString()
-				in.WantColon()
-				if in.IsNull() {
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				}
-				switch key[0] {
-				case 'i':
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				case 'b':
-					update.BirthDate = int(in.Int())
-					birthDate = true
-				case 'e':
-					update.Email = in.String()
-					email = true
-				case 'f':
-					update.FirstName = in.String()
-					firstName = true
-				case 'l':
-					update.LastName = in.String()
-					lastName = true
-				case 'g':
-					update.Gender = in.String()
-					gender = true
-				default:
-					in.SkipRecursive()
-				}
-				in.WantComma()
-			}
-			if !in.Ok() {
-				ctx.SetStatusCode(fasthttp.StatusBadRequest)
-				return nil
-			}
-			if birthDate {
-				user.BirthDate = update.BirthDate
-				user.CalculateAge()
-			}
-			if email {
-				user.Email = update.Email
-			}
-			if firstName {
-				user.FirstName = update.FirstName
-			}
-			if lastName {
-				user.LastName = update.LastName
-			}
-			if gender {
-				user.Gender = update.Gender
-			}
-			return emptyJSON
-		}
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
-		return nil
-	case 'l':
-		if id < int64(len(locations)) && locations[id] != nil {
-			update := new(Location)
-			location := locations[id]
-			distance, place, country, city := false, false, false, false
-			in := jlexer.Lexer{Data: ctx.PostBody()}
-			in.Delim('{')
-			for !in.IsDelim('}') {
-				key := in.UnsafeString()
-				key0 := key[0]
-				in.WantColon()
-				if in.IsNull() {
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				}
-				switch {
-				case key0 == 'i':
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				case key0 == 'd':
-					update.Distance = int(in.Int())
-					distance = true
-				case key0 == 'p':
-					update.Place = in.String()
-					place = true
-				case key0 == 'c' && key[1] == 'o':
-					update.Country = in.String()
-					country = true
-				case key0 == 'c' && key[1] == 'i':
-					update.City = in.String()
-					city = true
-				default:
-					in.SkipRecursive()
-				}
-				in.WantComma()
-			}
-			if !in.Ok() {
-				ctx.SetStatusCode(fasthttp.StatusBadRequest)
-				return nil
-			}
-			if distance {
-				location.Distance = update.Distance
-			}
-			if place {
-				location.Place = update.Place
-			}
-			if country {
-				location.Country = update.Country
-			}
-			if city {
-				location.City = update.City
-			}
-			return emptyJSON
-		}
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
-		return nil
-	case 'v':
-		if id < int64(len(visits)) && visits[id] != nil {
-			update := new(Visit)
-			visit := visits[id]
-			location, user, visitedAt, mark := false, false, false, false
-			in := jlexer.Lexer{Data: ctx.PostBody()}
-			in.Delim('{')
-			for !in.IsDelim('}') {
-				key := in.UnsafeString()
-				in.WantColon()
-				if in.IsNull() {
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				}
-				switch key[0] {
-				case 'i':
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				case 'l':
-					update.Location = int(in.Int())
-					location = visit.Location != update.Location
-				case 'u':
-					update.User = int(in.Int())
-					user = visit.User != update.User
-				case 'v':
-					update.VisitedAt = int(in.Int())
-					visitedAt = true
-				case 'm':
-					update.Mark = int(in.Int())
-					mark = true
-				default:
-					in.SkipRecursive()
-				}
-				in.WantComma()
-			}
-			if !in.Ok() {
-				ctx.SetStatusCode(fasthttp.StatusBadRequest)
-				return nil
-			}
-			if location {
-				if len(locations) < update.Location || locations[update.Location] == nil {
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				}
-				for i, v := range visit.locationRef.visits {
-					if v != nil && v.ID == visit.ID {
-						// visit.locationRef.visits = append(visit.locationRef.visits[:i], visit.locationRef.visits[i+1:]...)
-						visit.locationRef.visits[i] = nil
-						break
-					}
-				}
-				visit.Location = update.Location
-				visit.locationRef = locations[update.Location]
-				visit.locationRef.visits = append(visit.locationRef.visits, visit)
-			}
-			if user {
-				if len(users) < update.User || users[update.User] == nil {
-					ctx.SetStatusCode(fasthttp.StatusBadRequest)
-					return nil
-				}
-				for i, v := range visit.userRef.visits {
-					if v != nil && v.ID == visit.ID {
-						// visit.userRef.visits = append(visit.userRef.visits[:i], visit.userRef.visits[i+1:]...)
-						visit.userRef.visits[i] = nil
-						break
-					}
-				}
-				visit.User = update.User
-				visit.userRef = users[update.User]
-				visit.userRef.visits = append(visit.userRef.visits, visit)
-			}
-			if visitedAt {
-				visit.VisitedAt = update.VisitedAt
-			}
-			if mark {
-				visit.Mark = update.Mark
-			}
-			return emptyJSON
-		}
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
-		return nil
+	if err := updateEntity(currentStore(), entity, id, body); err != nil {
+		return fail(ctx, err)
+	}
+	return encode(ctx, emptyObject{})
+}
+
+func Delete(ctx *fasthttp.RequestCtx, entity byte, idBytes []byte) []byte {
+	id, ok := parseID(idBytes)
+	if !ok {
+		return fail(ctx, errBadID)
+	}
+	if err := deleteEntity(currentStore(), entity, id, *deletePolicy); err != nil {
+		return fail(ctx, err)
+	}
+	return encode(ctx, emptyObject{})
+}
+
+// ClockNow reports the time ages are currently computed against.
+func ClockNow(ctx *fasthttp.RequestCtx) []byte {
+	body := append([]byte(`{"now":`), strconv.Itoa(clock.Now())...)
+	return append(body, '}')
+}
+
+// SetClock pins the clock to ?now=<unix seconds> until it is reset with
+// DELETE /admin/clock.
+func SetClock(ctx *fasthttp.RequestCtx) []byte {
+	now, err := strconv.Atoi(string(ctx.QueryArgs().Peek("now")))
+	if err != nil {
+		return fail(ctx, &Error{fasthttp.StatusBadRequest, "invalid_argument", "now", "now must be an integer"})
 	}
-	ctx.SetStatusCode(fasthttp.StatusNotFound)
-	return nil
+	clock.Set(now)
+	return ClockNow(ctx)
 }
 
 var emptyJSON = []byte("{}")
-var countryBytes = []byte("country")
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// getVisits fetches /users/{id}/visits with query and decodes the page.
+func getVisits(t *testing.T, id int, query string) VisitsResult {
+	t.Helper()
+	ctx := newRequest(fmt.Sprintf("/users/%d/visits?%s", id, query))
+	body := Visits(ctx, []byte(fmt.Sprint(id)))
+	if status := ctx.Response.StatusCode(); status != 200 {
+		t.Fatalf("%s: %d %s", query, status, body)
+	}
+	var result VisitsResult
+	if err := result.UnmarshalJSON(body); err != nil {
+		t.Fatalf("%s: %v in %s", query, err, body)
+	}
+	return result
+}
+
+// getAvg fetches /locations/{id}/avg with query and decodes the average.
+func getAvg(t *testing.T, id int, query string) float64 {
+	t.Helper()
+	ctx := newRequest(fmt.Sprintf("/locations/%d/avg?%s", id, query))
+	body := Avg(ctx, []byte(fmt.Sprint(id)))
+	if status := ctx.Response.StatusCode(); status != 200 {
+		t.Fatalf("%s: %d %s", query, status, body)
+	}
+	var result AvgResult
+	if err := result.UnmarshalJSON(body); err != nil {
+		t.Fatalf("%s: %v in %s", query, err, body)
+	}
+	return result.Avg
+}
+
+// wantVisits is what /users/{id}/visits should list for the visits of s
+// that pass keep, worked out by walking every visit.
+func wantVisits(s *Store, id int, keep func(*Visit) bool) []VisitResult {
+	visits := make([]*Visit, 0)
+	s.EachVisit(func(visit *Visit) {
+		if visit.User == id && keep(visit) {
+			visits = append(visits, visit)
+		}
+	})
+	sort.Slice(visits, func(i, j int) bool {
+		a, b := visits[i], visits[j]
+		return a.VisitedAt < b.VisitedAt || a.VisitedAt == b.VisitedAt && a.ID < b.ID
+	})
+	results := make([]VisitResult, len(visits))
+	for i, visit := range visits {
+		results[i] = VisitResult{Mark: visit.Mark, VisitedAt: visit.VisitedAt, Place: s.Location(visit.Location).Place}
+	}
+	return results
+}
+
+// wantAvg is the mark /locations/{id}/avg should give over the visits of s
+// that pass keep, rounded the way Avg rounds it.
+func wantAvg(s *Store, id int, keep func(*Visit) bool) float64 {
+	sum, count := 0, 0
+	s.EachVisit(func(visit *Visit) {
+		if visit.Location == id && keep(visit) {
+			sum += visit.Mark
+			count++
+		}
+	})
+	if count == 0 {
+		return 0
+	}
+	return float64(round(float64(sum)/float64(count)*1e5)) / 1e5
+}
+
+func anyVisit(*Visit) bool { return true }
+
+// newCursorStore makes a store whose user 1 has 30 visits, three to each
+// visited_at, so pages routinely end in the middle of a tie.
+func newCursorStore(t *testing.T) *Store {
+	s := newTestStore(t, 2, 5, 0)
+	for id := 1; id <= 30; id++ {
+		mustCreate(t, s, 'v', fmt.Sprintf(`{"id":%d,"location":%d,"user":1,"visited_at":%d,"mark":%d}`, id, id%5+1, (id+1)/3*100, id%6))
+	}
+	return s
+}
+
+func TestVisitsCursorRoundTrip(t *testing.T) {
+	newCursorStore(t)
+	for _, order := range []string{"asc", "desc"} {
+		for _, filter := range []string{"", "&fromDate=250&toDate=900", "&toMark=4"} {
+			all := getVisits(t, 1, "order="+order+filter)
+			if all.Next != "" {
+				t.Errorf("order=%s%s: unpaged result has a cursor", order, filter)
+			}
+			for _, limit := range []int{1, 2, 3, 4, 7, 100} {
+				paged := make([]VisitResult, 0)
+				cursor := ""
+				for pages := 0; ; pages++ {
+					if pages > len(all.Visits) {
+						t.Fatalf("order=%s%s limit=%d: pages never end", order, filter, limit)
+					}
+					page := getVisits(t, 1, fmt.Sprintf("order=%s&limit=%d&cursor=%s%s", order, limit, cursor, filter))
+					if len(page.Visits) > limit || page.Next != "" && len(page.Visits) < limit {
+						t.Fatalf("order=%s%s limit=%d: page of %d with next %q", order, filter, limit, len(page.Visits), page.Next)
+					}
+					paged = append(paged, page.Visits...)
+					if page.Next == "" {
+						break
+					}
+					cursor = page.Next
+				}
+				if fmt.Sprint(paged) != fmt.Sprint(all.Visits) {
+					t.Errorf("order=%s%s limit=%d: pages give %v, want %v", order, filter, limit, paged, all.Visits)
+				}
+			}
+		}
+	}
+}
+
+// TestVisitsCursorAfterDelete checks that a page resumes where the last
+// one ended even when the visit the cursor names is gone.
+func TestVisitsCursorAfterDelete(t *testing.T) {
+	s := newCursorStore(t)
+	for _, order := range []string{"asc", "desc"} {
+		all := getVisits(t, 1, "order="+order)
+		first := getVisits(t, 1, "limit=4&order="+order)
+		at, id, ok := parseCursor([]byte(first.Next))
+		if !ok || at != first.Visits[3].VisitedAt {
+			t.Fatalf("order=%s: cursor %q does not name the last visit returned", order, first.Next)
+		}
+		if err := deleteEntity(s, 'v', id, deleteReject); err != nil {
+			t.Fatal(err)
+		}
+		rest := getVisits(t, 1, "order="+order+"&cursor="+first.Next)
+		if got := fmt.Sprint(append(first.Visits, rest.Visits...)); got != fmt.Sprint(all.Visits) {
+			t.Errorf("order=%s: got %v, want %v", order, got, all.Visits)
+		}
+		mustCreate(t, s, 'v', fmt.Sprintf(`{"id":%d,"location":%d,"user":1,"visited_at":%d,"mark":%d}`, id, id%5+1, at, id%6))
+	}
+}
+
+func TestCursorFormat(t *testing.T) {
+	for _, c := range [][2]int{{0, 1}, {100, 7}, {-1500000000, 2147483647}} {
+		at, id, ok := parseCursor([]byte(formatCursor(c[0], c[1])))
+		if !ok || at != c[0] || id != c[1] {
+			t.Errorf("%v came back as %d, %d, %v", c, at, id, ok)
+		}
+	}
+	newCursorStore(t)
+	for _, cursor := range []string{"x", "MTAw", "MTAwLg", "YS4x", "MTAwLmE", "!!"} {
+		ctx := newRequest("/users/1/visits?cursor=" + cursor)
+		Visits(ctx, []byte("1"))
+		if status := ctx.Response.StatusCode(); status != 400 {
+			t.Errorf("cursor %q: status %d, want 400", cursor, status)
+		}
+	}
+}
+
+// newFilterStore gives user 1 a hundred visits over locations that differ
+// in every filtered field, a few sharing a place prefix.
+func newFilterStore(t *testing.T) *Store {
+	s := newTestStore(t, 3, 10, 300)
+	for i, place := range []string{"Park", "Parkside", "Парк Горького"} {
+		mustCreate(t, s, 'l', fmt.Sprintf(`{"id":%d,"place":%q,"country":"C9","city":"T9","distance":%d}`, 11+i, place, 15*i))
+		for j := 0; j < 6; j++ {
+			id := 301 + i*6 + j
+			mustCreate(t, s, 'v', fmt.Sprintf(`{"id":%d,"location":%d,"user":1,"visited_at":%d,"mark":%d}`, id, 11+i, id*500, j))
+		}
+	}
+	return s
+}
+
+func TestVisitsFilters(t *testing.T) {
+	s := newFilterStore(t)
+	location := func(x *Visit) *Location { return s.Location(x.Location) }
+	tests := []struct {
+		query string
+		keep  func(*Visit) bool
+	}{
+		{"city=T2", func(x *Visit) bool { return location(x).City == "T2" }},
+		{"city=T2&country=C1", func(x *Visit) bool { return location(x).City == "T2" && location(x).Country == "C1" }},
+		{"city=Nowhere", func(x *Visit) bool { return false }},
+		{"place=P3", func(x *Visit) bool { return location(x).Place == "P3" }},
+		{"place=Park", func(x *Visit) bool { return x.Location == 11 }},
+		{"placePrefix=Park", func(x *Visit) bool { return x.Location == 11 || x.Location == 12 }},
+		{"placePrefix=Parks", func(x *Visit) bool { return x.Location == 12 }},
+		{"placePrefix=P", func(x *Visit) bool { return strings.HasPrefix(location(x).Place, "P") }},
+		{"placePrefix=" + url.QueryEscape("Парк"), func(x *Visit) bool { return x.Location == 13 }},
+		{"placePrefix=park", func(x *Visit) bool { return false }},
+		{"locationId=4", func(x *Visit) bool { return x.Location == 4 }},
+		{"locationId=12&placePrefix=Park", func(x *Visit) bool { return x.Location == 12 }},
+		{"locationId=99", func(x *Visit) bool { return false }},
+		{"fromDistance=15", func(x *Visit) bool { return location(x).Distance > 15 }},
+		{"fromDistance=15&toDistance=30", func(x *Visit) bool { return location(x).Distance > 15 && location(x).Distance < 30 }},
+		{"fromDistance=0&city=T9", func(x *Visit) bool { return x.Location == 12 || x.Location == 13 }},
+		{"fromMark=2", func(x *Visit) bool { return x.Mark > 2 }},
+		{"toMark=4", func(x *Visit) bool { return x.Mark < 4 }},
+		{"fromMark=2&toMark=4", func(x *Visit) bool { return x.Mark == 3 }},
+		{"fromMark=3&toMark=4", func(x *Visit) bool { return false }},
+		{"fromMark=5", func(x *Visit) bool { return false }},
+		{"toMark=0", func(x *Visit) bool { return false }},
+		{"placePrefix=P&fromMark=1&fromDate=20000&toDate=80000", func(x *Visit) bool {
+			return strings.HasPrefix(location(x).Place, "P") && x.Mark > 1 && x.VisitedAt > 20000 && x.VisitedAt < 80000
+		}},
+	}
+	for _, test := range tests {
+		want := wantVisits(s, 1, test.keep)
+		if got := getVisits(t, 1, test.query); fmt.Sprint(got.Visits) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", test.query, got.Visits, want)
+		}
+		for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+			want[i], want[j] = want[j], want[i]
+		}
+		if got := getVisits(t, 1, test.query+"&order=desc"); fmt.Sprint(got.Visits) != fmt.Sprint(want) {
+			t.Errorf("%s&order=desc: got %v, want %v", test.query, got.Visits, want)
+		}
+	}
+}
+
+// TestVisitsMarkBoundsStrict pins fromMark and toMark as exclusive, like
+// the other bounds: a visit marked exactly at a bound is left out.
+func TestVisitsMarkBoundsStrict(t *testing.T) {
+	newFilterStore(t)
+	all := getVisits(t, 1, "")
+	for mark := 0; mark <= 5; mark++ {
+		above, below := 0, 0
+		for _, visit := range all.Visits {
+			if visit.Mark > mark {
+				above++
+			}
+			if visit.Mark < mark {
+				below++
+			}
+		}
+		for _, visit := range getVisits(t, 1, fmt.Sprintf("fromMark=%d", mark)).Visits {
+			if visit.Mark <= mark {
+				t.Errorf("fromMark=%d kept a visit marked %d", mark, visit.Mark)
+			}
+			above--
+		}
+		for _, visit := range getVisits(t, 1, fmt.Sprintf("toMark=%d", mark)).Visits {
+			if visit.Mark >= mark {
+				t.Errorf("toMark=%d kept a visit marked %d", mark, visit.Mark)
+			}
+			below--
+		}
+		if above != 0 || below != 0 {
+			t.Errorf("mark %d: %d visits above and %d below were dropped", mark, above, below)
+		}
+	}
+}
+
+func TestVisitsFilterErrors(t *testing.T) {
+	newFilterStore(t)
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"locationId=abc", "locationId"},
+		{"locationId=-4", "locationId"},
+		{"fromDistance=-3", "fromDistance"},
+		{"toDistance=1.5", "toDistance"},
+		{"fromMark=x", "fromMark"},
+		{"toMark=-1", "toMark"},
+		{"toMark=99999999999999999999", "toMark"},
+		// the first bad argument is the one reported
+		{"fromMark=x&locationId=y", "locationId"},
+		{"order=up", "order"},
+		{"order=DESC", "order"},
+		{"limit=0", "limit"},
+	}
+	for _, test := range tests {
+		ctx := newRequest("/users/1/visits?" + test.query)
+		body := Visits(ctx, []byte("1"))
+		if status := ctx.Response.StatusCode(); status != 400 {
+			t.Errorf("%s: status %d, want 400", test.query, status)
+		}
+		if want := fmt.Sprintf(`"field":%q`, test.field); !strings.Contains(string(body), want) {
+			t.Errorf("%s: body %s, want %s", test.query, body, want)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot is a varint-encoded dump of the whole store:
+//
+//	magic, wal lsn, dataset date
+//	users      id birth_date email first_name last_name gender ... 0
+//	locations  id distance place country city ... 0
+//	visits     id location user visited_at mark ... 0
+//	user adjacency      id n visit_id*n ... 0
+//	location adjacency  id n visit_id*n ... 0
+//	crc32 of everything above
+//
+// Entity IDs are always positive, so a zero ID terminates each section.
+// Adjacency lists are in the store's order and left out for owners with
+// no visits; a location's gender buckets follow one another.
+const snapshotMagic = "HLSNAP1\n"
+const snapshotPrefix = "snapshot-"
+const snapshotSuffix = ".bin"
+const snapshotsKept = 2
+
+var errSnapshotCorrupt = errors.New("snapshot: corrupt data")
+
+// snapshotWriter encodes into memory, so the store lock is not held across
+// any IO.
+type snapshotWriter struct {
+	data []byte
+	buf  [binary.MaxVarintLen64]byte
+}
+
+func (w *snapshotWriter) int(v int) {
+	n := binary.PutVarint(w.buf[:], int64(v))
+	w.data = append(w.data, w.buf[:n]...)
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.int(len(s))
+	w.data = append(w.data, s...)
+}
+
+type snapshotReader struct {
+	data []byte
+	err  error
+}
+
+func (r *snapshotReader) int() int {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err, r.data = errSnapshotCorrupt, nil
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(v)
+}
+
+func (r *snapshotReader) string() string {
+	n := r.int()
+	if n < 0 || n > len(r.data) {
+		r.err, r.data = errSnapshotCorrupt, nil
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+// WriteSnapshot dumps s into dir and, once the file is durable, truncates
+// the WAL if every record in it is covered by the snapshot. The store is
+// encoded from a cut, so writers are only held up while its page
+// directories are copied and readers only for a page at a time; writing and
+// syncing the file happen without any lock. If s has been replaced by a
+// reload, its successor is written instead.
+func WriteSnapshot(s *Store, dir string) (string, error) {
+	snapshotFileMu.Lock()
+	defer snapshotFileMu.Unlock()
+	data, lsn := encodeSnapshot(s)
+
+	tmp, err := ioutil.TempFile(dir, snapshotPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	name := path.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, time.Now().UnixNano(), snapshotSuffix))
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return "", err
+	}
+	// mutations logged while the file was written are not in it; the log
+	// then stays as is and replay skips the records the snapshot covers
+	if err := wal.Reset(lsn); err != nil {
+		return name, err
+	}
+	pruneSnapshots(dir)
+	return name, nil
+}
+
+// storeCut is a store as it was at one WAL position, kept while the store
+// goes on changing so that a snapshot can be encoded without holding the
+// lock for the whole walk. Opening it copies only the page directories.
+// From then on the first change to an entity, in place or to its slot,
+// records the entity as it was, or nil if it did not exist, and the encoder
+// prefers those records over what it finds in the pages.
+type storeCut struct {
+	users     []*userPage
+	locations []*locationPage
+	visits    []*visitPage
+
+	visitCount int
+	date       int
+	lsn        uint64
+
+	oldUsers     map[int]*User
+	oldLocations map[int]*Location
+	oldVisits    map[int]*Visit
+}
+
+// snapshotMu keeps to one cut at a time. snapshotFileMu keeps to one file
+// at a time, so files are named in the order of the WAL positions they
+// cover: an older one finishing late would become the newest after a newer
+// one, say a reload's, had reset the log.
+var snapshotMu, snapshotFileMu sync.Mutex
+
+// keepUser records user id for the open cut, if there is one, before it
+// changes. Callers hold the write lock.
+func (s *Store) keepUser(id int) {
+	if s.cut == nil {
+		return
+	}
+	if _, ok := s.cut.oldUsers[id]; ok {
+		return
+	}
+	var old *User
+	if user := s.User(id); user != nil {
+		kept := *user
+		kept.visits = visitList{}
+		old = &kept
+	}
+	s.cut.oldUsers[id] = old
+}
+
+func (s *Store) keepLocation(id int) {
+	if s.cut == nil {
+		return
+	}
+	if _, ok := s.cut.oldLocations[id]; ok {
+		return
+	}
+	var old *Location
+	if location := s.Location(id); location != nil {
+		kept := *location
+		kept.visits = locationVisits{}
+		old = &kept
+	}
+	s.cut.oldLocations[id] = old
+}
+
+func (s *Store) keepVisit(id int) {
+	if s.cut == nil {
+		return
+	}
+	if _, ok := s.cut.oldVisits[id]; ok {
+		return
+	}
+	var old *Visit
+	if visit := s.Visit(id); visit != nil {
+		kept := *visit
+		kept.userRef, kept.locationRef = nil, nil
+		old = &kept
+	}
+	s.cut.oldVisits[id] = old
+}
+
+// encodeSnapshot renders s, crc included, along with the WAL lsn it is
+// consistent with.
+func encodeSnapshot(s *Store) ([]byte, uint64) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	s, cut := openCut(s)
+	defer s.closeCut()
+	return cut.encode(s), cut.lsn
+}
+
+// openCut starts a cut of the live store reachable from s at the current
+// WAL position and returns both.
+func openCut(s *Store) (*Store, *storeCut) {
+	// only writers look at s.cut, and the read lock keeps them out
+	s = s.rLockLive()
+	defer s.RUnlock()
+	s.cut = &storeCut{
+		users:        append([]*userPage(nil), s.users...),
+		locations:    append([]*locationPage(nil), s.locations...),
+		visits:       append([]*visitPage(nil), s.visits...),
+		visitCount:   s.visitCount,
+		date:         s.date,
+		lsn:          wal.LSN(),
+		oldUsers:     make(map[int]*User),
+		oldLocations: make(map[int]*Location),
+		oldVisits:    make(map[int]*Visit),
+	}
+	return s, s.cut
+}
+
+func (s *Store) closeCut() {
+	s.RLock()
+	s.cut = nil
+	s.RUnlock()
+}
+
+// encode renders the cut of s. Each page is read under the read lock on its
+// own. The visit lists are not read at all: they follow from the visits in
+// the cut and are rebuilt from them in the store's order.
+func (cut *storeCut) encode(s *Store) []byte {
+	w := &snapshotWriter{data: make([]byte, 0, 1<<20)}
+	w.data = append(w.data, snapshotMagic...)
+	w.int(int(cut.lsn))
+	w.int(cut.date)
+
+	genders := make([][]uint8, len(cut.users))
+	for p, page := range cut.users {
+		if page == nil {
+			continue
+		}
+		genders[p] = make([]uint8, pageSize)
+		s.RLock()
+		for i, user := range page {
+			if old, ok := cut.oldUsers[p<<pageBits|i]; ok {
+				user = old
+			}
+			if user == nil {
+				continue
+			}
+			w.int(user.ID)
+			w.int(user.BirthDate)
+			w.string(user.Email)
+			w.string(user.FirstName)
+			w.string(user.LastName)
+			w.string(user.Gender)
+			genders[p][i] = uint8(genderBucket(user.Gender))
+		}
+		s.RUnlock()
+	}
+	w.int(0)
+	for p, page := range cut.locations {
+		if page == nil {
+			continue
+		}
+		s.RLock()
+		for i, location := range page {
+			if old, ok := cut.oldLocations[p<<pageBits|i]; ok {
+				location = old
+			}
+			if location == nil {
+				continue
+			}
+			w.int(location.ID)
+			w.int(location.Distance)
+			w.string(location.Place)
+			w.string(location.Country)
+			w.string(location.City)
+		}
+		s.RUnlock()
+	}
+	w.int(0)
+	visits := make([]cutVisit, 0, cut.visitCount)
+	for p, page := range cut.visits {
+		if page == nil {
+			continue
+		}
+		s.RLock()
+		for i, visit := range page {
+			if old, ok := cut.oldVisits[p<<pageBits|i]; ok {
+				visit = old
+			}
+			if visit == nil {
+				continue
+			}
+			w.int(visit.ID)
+			w.int(visit.Location)
+			w.int(visit.User)
+			w.int(visit.VisitedAt)
+			w.int(visit.Mark)
+			visits = append(visits, cutVisit{
+				at:       visit.VisitedAt,
+				id:       int32(visit.ID),
+				user:     int32(visit.User),
+				location: int32(visit.Location),
+				bucket:   genders[visit.User>>pageBits][visit.User&pageMask],
+			})
+		}
+		s.RUnlock()
+	}
+	w.int(0)
+
+	w.adjacency(groupVisits(visits, len(cut.users), 1, func(v *cutVisit) (int, int) {
+		return int(v.user), 0
+	}))
+	w.adjacency(groupVisits(visits, len(cut.locations), genderBuckets, func(v *cutVisit) (int, int) {
+		return int(v.location), int(v.bucket)
+	}))
+	binary.LittleEndian.PutUint32(w.buf[:], crc32.ChecksumIEEE(w.data))
+	return append(w.data, w.buf[:4]...)
+}
+
+// cutVisit is what the adjacency sections need of a visit in a cut.
+type cutVisit struct {
+	at       int
+	id       int32
+	user     int32
+	location int32
+	bucket   uint8
+}
+
+// visitGroups is the visits of a cut ordered the way the store's visit
+// lists are: by owner, then by group within the owner (the gender buckets
+// of a location), then by (visited_at, id).
+type visitGroups struct {
+	visits []cutVisit
+	width  int
+	// ends holds, per page of owners, where each owner's groups end in
+	// order; pages without visits are nil
+	ends  [][]int32
+	order []int32
+}
+
+// groupVisits sorts visits, which are in ID order, into groups with a
+// counting sort over the owner IDs, so the cost stays linear in the number
+// of visits plus the short sorts by visited_at within each group.
+func groupVisits(visits []cutVisit, pages, width int, key func(*cutVisit) (owner, group int)) *visitGroups {
+	g := &visitGroups{visits: visits, width: width, ends: make([][]int32, pages), order: make([]int32, len(visits))}
+	for i := range visits {
+		owner, group := key(&visits[i])
+		p := owner >> pageBits
+		if g.ends[p] == nil {
+			g.ends[p] = make([]int32, pageSize*width)
+		}
+		g.ends[p][(owner&pageMask)*width+group]++
+	}
+	// counts become starts, which placing the visits turns into ends
+	n := int32(0)
+	for _, ends := range g.ends {
+		for j, count := range ends {
+			ends[j] = n
+			n += count
+		}
+	}
+	for i := range visits {
+		owner, group := key(&visits[i])
+		end := &g.ends[owner>>pageBits][(owner&pageMask)*width+group]
+		g.order[*end] = int32(i)
+		*end++
+	}
+	// placing kept ID order, so a stable sort by visited_at gives
+	// (visited_at, id)
+	byAt := &byVisitedAt{visits: visits}
+	start := int32(0)
+	for _, ends := range g.ends {
+		for _, end := range ends {
+			if end-start > 1 {
+				byAt.order = g.order[start:end]
+				sort.Stable(byAt)
+			}
+			start = end
+		}
+	}
+	return g
+}
+
+type byVisitedAt struct {
+	order  []int32
+	visits []cutVisit
+}
+
+func (b *byVisitedAt) Len() int      { return len(b.order) }
+func (b *byVisitedAt) Swap(i, j int) { b.order[i], b.order[j] = b.order[j], b.order[i] }
+func (b *byVisitedAt) Less(i, j int) bool {
+	return b.visits[b.order[i]].at < b.visits[b.order[j]].at
+}
+
+// adjacency writes a section of visit lists, skipping owners without
+// visits. An owner's groups are written one after the other.
+func (w *snapshotWriter) adjacency(g *visitGroups) {
+	start := int32(0)
+	for p, ends := range g.ends {
+		for slot := 0; slot < len(ends); slot += g.width {
+			end := ends[slot+g.width-1]
+			if end == start {
+				continue
+			}
+			w.int(p<<pageBits | slot/g.width)
+			w.int(int(end - start))
+			for _, i := range g.order[start:end] {
+				w.int(int(g.visits[i].id))
+			}
+			start = end
+		}
+	}
+	w.int(0)
+}
+
+func listSnapshots(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0)
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func pruneSnapshots(dir string) {
+	names := listSnapshots(dir)
+	for i := 0; i < len(names)-snapshotsKept; i++ {
+		if err := os.Remove(path.Join(dir, names[i])); err != nil {
+			log.Println("snapshot:", err)
+		}
+	}
+}
+
+// LoadSnapshot fills s from the newest readable snapshot in dir and returns
+// the WAL lsn it covers. ok is false when there is nothing to boot from.
+func LoadSnapshot(s *Store, dir string) (lsn uint64, ok bool) {
+	names := listSnapshots(dir)
+	for i := len(names) - 1; i >= 0; i-- {
+		name := path.Join(dir, names[i])
+		lsn, err := readSnapshot(s, name)
+		if err == nil {
+			log.Printf("snapshot: loaded %s at lsn %d", name, lsn)
+			return lsn, true
+		}
+		log.Printf("snapshot: skipping %s: %v", name, err)
+	}
+	return 0, false
+}
+
+func readSnapshot(s *Store, name string) (uint64, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, errSnapshotCorrupt
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return 0, errSnapshotCorrupt
+	}
+
+	r := &snapshotReader{data: body[len(snapshotMagic):]}
+	lsn := uint64(r.int())
+	date := r.int()
+
+	// entities go into a scratch store first so a snapshot that turns
+	// out to be inconsistent half way through leaves s untouched
+	tmp := NewStore(0, 0, 0)
+	loaded := false
+	defer func() {
+		if !loaded {
+			tmp.forgetVisitLists()
+		}
+	}()
+	for id := r.int(); id > 0; id = r.int() {
+		user := &User{ID: id, BirthDate: r.int()}
+		user.Email, user.FirstName, user.LastName, user.Gender = r.string(), r.string(), r.string(), r.string()
+		tmp.SetUser(user)
+	}
+	for id := r.int(); id > 0; id = r.int() {
+		location := &Location{ID: id, Distance: r.int()}
+		location.Place, location.Country, location.City = r.string(), r.string(), r.string()
+		tmp.SetLocation(location)
+	}
+	for id := r.int(); id > 0; id = r.int() {
+		visit := &Visit{ID: id, Location: r.int(), User: r.int(), VisitedAt: r.int(), Mark: r.int()}
+		visit.userRef, visit.locationRef = tmp.User(visit.User), tmp.Location(visit.Location)
+		if visit.userRef == nil || visit.locationRef == nil {
+			return 0, errSnapshotCorrupt
+		}
+		tmp.SetVisit(visit)
+	}
+	for id := r.int(); id > 0; id = r.int() {
+		user := tmp.User(id)
+		if user == nil {
+			return 0, errSnapshotCorrupt
+		}
+		if user.visits.items, err = readAdjacency(r, tmp); err != nil {
+			return 0, err
+		}
+		atomic.AddInt64(&listSlots, int64(len(user.visits.items)))
+	}
+	for id := r.int(); id > 0; id = r.int() {
+		location := tmp.Location(id)
+		if location == nil {
+			return 0, errSnapshotCorrupt
+		}
+		entries, err := readAdjacency(r, tmp)
+		if err != nil {
+			return 0, err
+		}
+		// buckets are written one after the other, each in order, so
+		// appending to the visit's bucket keeps every bucket ordered
+		for _, entry := range entries {
+			location.visits.add(entry.visit)
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	s.date = date
+	s.users, s.locations, s.visits = tmp.users, tmp.locations, tmp.visits
+	s.userCount, s.locationCount, s.visitCount = tmp.userCount, tmp.locationCount, tmp.visitCount
+	loaded = true
+	return lsn, nil
+}
+
+// readAdjacency reads a visit list in the order it was written, which keeps
+// ordered lists ordered.
+func readAdjacency(r *snapshotReader, s *Store) ([]visitEntry, error) {
+	n := r.int()
+	if n < 0 || n > len(r.data) {
+		return nil, errSnapshotCorrupt
+	}
+	entries := make([]visitEntry, n)
+	for i := range entries {
+		visit := s.Visit(r.int())
+		if visit == nil {
+			return nil, errSnapshotCorrupt
+		}
+		entries[i] = visitEntry{visit.VisitedAt, visit}
+	}
+	return entries, nil
+}
+
+func snapshotLoop(dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		start := time.Now()
+		name, err := WriteSnapshot(currentStore(), dir)
+		if err != nil {
+			log.Println("snapshot:", err)
+			continue
+		}
+		log.Printf("snapshot: wrote %s in %v", name, time.Since(start))
+	}
+}
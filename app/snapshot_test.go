@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s := newTestStore(t, 20, 10, 400)
+	deleteEntity(s, 'v', 7, deleteReject)
+	updateEntity(s, 'v', 8, []byte(`{"visited_at":5,"user":3}`))
+	dir := t.TempDir()
+	if _, err := WriteSnapshot(s, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewStore(0, 0, 0)
+	if _, ok := LoadSnapshot(loaded, dir); !ok {
+		t.Fatal("snapshot not loaded")
+	}
+	if loaded.userCount != 20 || loaded.locationCount != 10 || loaded.visitCount != 399 {
+		t.Errorf("loaded %d users, %d locations, %d visits", loaded.userCount, loaded.locationCount, loaded.visitCount)
+	}
+	s.EachVisit(func(visit *Visit) {
+		got := loaded.Visit(visit.ID)
+		if got == nil || got.User != visit.User || got.Location != visit.Location || got.VisitedAt != visit.VisitedAt || got.Mark != visit.Mark {
+			t.Errorf("visit %d: got %+v, want %+v", visit.ID, got, visit)
+		}
+	})
+	checkVisitLists(t, loaded)
+}
+
+// TestSnapshotKeepsNewerRecords checks that the WAL is only emptied when the
+// snapshot covers all of it.
+func TestSnapshotKeepsNewerRecords(t *testing.T) {
+	s := newTestStore(t, 2, 2, 4)
+	dir := t.TempDir()
+	w, err := OpenWAL(filepath.Join(dir, "wal"), syncNever, 0, 0, replayWAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal = w
+	defer func() { wal = nil }()
+
+	updateEntity(s, 'v', 1, []byte(`{"mark":5}`))
+	if _, err := WriteSnapshot(s, dir); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "wal")); info.Size() != 0 {
+		t.Errorf("covered WAL left at %d bytes", info.Size())
+	}
+
+	data, lsn := encodeSnapshot(s)
+	updateEntity(s, 'v', 2, []byte(`{"mark":5}`))
+	if err := wal.Reset(lsn); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "wal")); info.Size() == 0 {
+		t.Errorf("WAL emptied with a record the %d byte snapshot misses", len(data))
+	}
+}
+
+// TestSnapshotCut changes every kind of entity while a cut is open and
+// expects the cut to encode exactly the store as it was when opened, and
+// to rebuild the changed store with the WAL records after it.
+func TestSnapshotCut(t *testing.T) {
+	s := newTestStore(t, 20, 10, 400)
+	dir := t.TempDir()
+	openTestWAL(t, filepath.Join(dir, "wal"), 0)
+	before, _ := encodeSnapshot(s)
+
+	snapshotMu.Lock()
+	s, cut := openCut(s)
+	mustCreate(t, s, 'u', `{"id":21,"email":"n@x.ru","first_name":"N","last_name":"U","gender":"f","birth_date":0}`)
+	mustCreate(t, s, 'v', `{"id":401,"location":3,"user":21,"visited_at":77,"mark":4}`)
+	changes := []func() *Error{
+		func() *Error {
+			return createEntity(s, 'u', []byte(`{"id":2,"email":"up@x.ru","first_name":"U","last_name":"P","gender":"m","birth_date":1}`), true)
+		},
+		func() *Error {
+			return createEntity(s, 'l', []byte(`{"id":4,"place":"Dock","country":"Peru","city":"Lima","distance":1}`), true)
+		},
+		func() *Error {
+			return createEntity(s, 'v', []byte(`{"id":9,"location":1,"user":21,"visited_at":3,"mark":0}`), true)
+		},
+		func() *Error { return updateEntity(s, 'u', 3, []byte(`{"gender":"f","email":"g@x.ru"}`)) },
+		func() *Error { return updateEntity(s, 'l', 5, []byte(`{"city":"Nowhere","distance":500}`)) },
+		func() *Error { return updateEntity(s, 'v', 10, []byte(`{"visited_at":1,"location":2,"user":4}`)) },
+		func() *Error { return deleteEntity(s, 'v', 11, deleteReject) },
+		func() *Error { return deleteEntity(s, 'u', 6, deleteCascade) },
+		func() *Error { return deleteEntity(s, 'l', 7, deleteCascade) },
+	}
+	for i, change := range changes {
+		if err := change(); err != nil {
+			t.Fatalf("change %d: %v", i, err)
+		}
+	}
+	data := cut.encode(s)
+	s.closeCut()
+	snapshotMu.Unlock()
+
+	if !bytes.Equal(data, before) {
+		t.Fatal("the cut does not encode the store as it was when opened")
+	}
+	name := filepath.Join(dir, "snapshot")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	closeTestWAL(wal)
+	loaded := NewStore(0, 0, 0)
+	if _, err := readSnapshot(loaded, name); err != nil {
+		t.Fatal(err)
+	}
+	live.Store(loaded)
+	openTestWAL(t, filepath.Join(dir, "wal"), cut.lsn)
+	checkSameStore(t, loaded, s)
+}
+
+// BenchmarkSnapshotWriterStall times updates with and without snapshots
+// being encoded alongside. max-µs is the longest an update waited, which
+// while snapshotting is bounded by how long the store lock is held.
+func BenchmarkSnapshotWriterStall(b *testing.B) {
+	const visits = 200000
+	s := newTestStore(b, 20000, 5000, visits)
+	body := []byte(`{"mark":3}`)
+	for _, snapshotting := range []bool{false, true} {
+		name := "idle"
+		if snapshotting {
+			name = "snapshotting"
+		}
+		b.Run(name, func(b *testing.B) {
+			stop := make(chan struct{})
+			var encoder sync.WaitGroup
+			if snapshotting {
+				encoder.Add(1)
+				go func() {
+					defer encoder.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						encodeSnapshot(s)
+					}
+				}()
+			}
+			var worst time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				updateEntity(s, 'v', i%visits+1, body)
+				if d := time.Since(start); d > worst {
+					worst = d
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			encoder.Wait()
+			b.ReportMetric(float64(worst.Microseconds()), "max-µs")
+		})
+	}
+}
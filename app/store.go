@@ -0,0 +1,312 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const pageBits = 12
+const pageSize = 1 << pageBits
+const pageMask = pageSize - 1
+
+// maxEntityID bounds the IDs the store accepts, keeping the page directory
+// for a single bogus ID at a few megabytes.
+const maxEntityID = math.MaxInt32
+
+type userPage [pageSize]*User
+type locationPage [pageSize]*Location
+type visitPage [pageSize]*Visit
+
+// Store keeps users, locations and visits in paged arrays indexed by ID.
+// Pages are allocated on first write, so sparse or small datasets only pay
+// for the pages they touch while lookups stay a shift and a mask.
+type Store struct {
+	sync.RWMutex
+
+	users     []*userPage
+	locations []*locationPage
+	visits    []*visitPage
+
+	userCount, locationCount, visitCount int
+
+	// date is the moment the dataset was generated, from options.txt.
+	date int
+
+	// successor is the store that replaced this one on reload. It is set
+	// under the write lock and never cleared.
+	successor *Store
+
+	// cut is the view a snapshot is being encoded from, while it is.
+	cut *storeCut
+}
+
+// live holds the store requests are served from. Its RWMutex guards its
+// entities and the visit lists hanging off them: GET handlers hold the read
+// lock for the whole request, POST handlers take the write lock only around
+// the mutation itself.
+var live atomic.Value
+
+// currentStore returns the store requests are served from. A handler takes
+// it once and keeps it for the whole request, so a reload never changes the
+// data under a request already in flight.
+func currentStore() *Store {
+	return live.Load().(*Store)
+}
+
+// replaceStore makes next, loaded from dataPath, the live store. The swap is
+// logged under the old store's write lock, so the WAL records it between
+// the last write to the old store and the first to next, and replay can
+// switch datasets at the same point; if the record cannot be written
+// nothing changes. Writers blocked on the old store move over to next
+// through lockLive once it is released, and the old store's visit lists
+// leave the list totals.
+func replaceStore(next *Store, dataPath string) error {
+	old := currentStore().lockLive()
+	if err := wal.Append(opReload, 0, 0, []byte(dataPath)); err != nil {
+		old.Unlock()
+		return err
+	}
+	live.Store(next)
+	old.successor = next
+	old.Unlock()
+	// nothing writes to old once it has a successor
+	old.forgetVisitLists()
+	return nil
+}
+
+// lockLive takes the write lock of the live store reachable from s and
+// returns it. Mutations lock through it so none lands on a store that has
+// been replaced while they waited.
+func (s *Store) lockLive() *Store {
+	for {
+		s.Lock()
+		if s.successor == nil {
+			return s
+		}
+		next := s.successor
+		s.Unlock()
+		s = next
+	}
+}
+
+// rLockLive is lockLive for the read lock.
+func (s *Store) rLockLive() *Store {
+	for {
+		s.RLock()
+		if s.successor == nil {
+			return s
+		}
+		next := s.successor
+		s.RUnlock()
+		s = next
+	}
+}
+
+func NewStore(users, locations, visits int) *Store {
+	s := new(Store)
+	s.users = make([]*userPage, pagesFor(users))
+	for i := range s.users {
+		s.users[i] = new(userPage)
+	}
+	s.locations = make([]*locationPage, pagesFor(locations))
+	for i := range s.locations {
+		s.locations[i] = new(locationPage)
+	}
+	s.visits = make([]*visitPage, pagesFor(visits))
+	for i := range s.visits {
+		s.visits[i] = new(visitPage)
+	}
+	return s
+}
+
+func pagesFor(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return (n + pageMask) >> pageBits
+}
+
+func validID(id int) bool {
+	return id > 0 && id <= maxEntityID
+}
+
+func (s *Store) User(id int) *User {
+	p := id >> pageBits
+	if id < 0 || p >= len(s.users) || s.users[p] == nil {
+		return nil
+	}
+	return s.users[p][id&pageMask]
+}
+
+func (s *Store) SetUser(user *User) {
+	s.keepUser(user.ID)
+	p := user.ID >> pageBits
+	for p >= len(s.users) {
+		s.users = append(s.users, nil)
+	}
+	if s.users[p] == nil {
+		s.users[p] = new(userPage)
+	}
+	if s.users[p][user.ID&pageMask] == nil {
+		s.userCount++
+	}
+	s.users[p][user.ID&pageMask] = user
+}
+
+func (s *Store) Location(id int) *Location {
+	p := id >> pageBits
+	if id < 0 || p >= len(s.locations) || s.locations[p] == nil {
+		return nil
+	}
+	return s.locations[p][id&pageMask]
+}
+
+func (s *Store) SetLocation(location *Location) {
+	s.keepLocation(location.ID)
+	p := location.ID >> pageBits
+	for p >= len(s.locations) {
+		s.locations = append(s.locations, nil)
+	}
+	if s.locations[p] == nil {
+		s.locations[p] = new(locationPage)
+	}
+	if s.locations[p][location.ID&pageMask] == nil {
+		s.locationCount++
+	}
+	s.locations[p][location.ID&pageMask] = location
+}
+
+func (s *Store) Visit(id int) *Visit {
+	p := id >> pageBits
+	if id < 0 || p >= len(s.visits) || s.visits[p] == nil {
+		return nil
+	}
+	return s.visits[p][id&pageMask]
+}
+
+func (s *Store) SetVisit(visit *Visit) {
+	s.keepVisit(visit.ID)
+	p := visit.ID >> pageBits
+	for p >= len(s.visits) {
+		s.visits = append(s.visits, nil)
+	}
+	if s.visits[p] == nil {
+		s.visits[p] = new(visitPage)
+	}
+	if s.visits[p][visit.ID&pageMask] == nil {
+		s.visitCount++
+	}
+	s.visits[p][visit.ID&pageMask] = visit
+}
+
+func (s *Store) RemoveUser(id int) {
+	s.keepUser(id)
+	p := id >> pageBits
+	if id >= 0 && p < len(s.users) && s.users[p] != nil && s.users[p][id&pageMask] != nil {
+		s.users[p][id&pageMask] = nil
+		s.userCount--
+	}
+}
+
+func (s *Store) EachUser(fn func(*User)) {
+	for _, page := range s.users {
+		if page == nil {
+			continue
+		}
+		for _, user := range page {
+			if user != nil {
+				fn(user)
+			}
+		}
+	}
+}
+
+func (s *Store) RemoveLocation(id int) {
+	s.keepLocation(id)
+	p := id >> pageBits
+	if id >= 0 && p < len(s.locations) && s.locations[p] != nil && s.locations[p][id&pageMask] != nil {
+		s.locations[p][id&pageMask] = nil
+		s.locationCount--
+	}
+}
+
+func (s *Store) EachLocation(fn func(*Location)) {
+	for _, page := range s.locations {
+		if page == nil {
+			continue
+		}
+		for _, location := range page {
+			if location != nil {
+				fn(location)
+			}
+		}
+	}
+}
+
+func (s *Store) RemoveVisit(id int) {
+	s.keepVisit(id)
+	p := id >> pageBits
+	if id >= 0 && p < len(s.visits) && s.visits[p] != nil && s.visits[p][id&pageMask] != nil {
+		s.visits[p][id&pageMask] = nil
+		s.visitCount--
+	}
+}
+
+func (s *Store) EachVisit(fn func(*Visit)) {
+	for _, page := range s.visits {
+		if page == nil {
+			continue
+		}
+		for _, visit := range page {
+			if visit != nil {
+				fn(visit)
+			}
+		}
+	}
+}
+
+// UserPage calls fn for every user on page p, the IDs p<<pageBits up to the
+// next page, and reports whether p exists at all. Walking the pages one at a
+// time lets a long scan release the lock between them.
+func (s *Store) UserPage(p int, fn func(*User)) bool {
+	if p >= len(s.users) {
+		return false
+	}
+	if page := s.users[p]; page != nil {
+		for _, user := range page {
+			if user != nil {
+				fn(user)
+			}
+		}
+	}
+	return true
+}
+
+func (s *Store) LocationPage(p int, fn func(*Location)) bool {
+	if p >= len(s.locations) {
+		return false
+	}
+	if page := s.locations[p]; page != nil {
+		for _, location := range page {
+			if location != nil {
+				fn(location)
+			}
+		}
+	}
+	return true
+}
+
+func (s *Store) VisitPage(p int, fn func(*Visit)) bool {
+	if p >= len(s.visits) {
+		return false
+	}
+	if page := s.visits[p]; page != nil {
+		for _, visit := range page {
+			if visit != nil {
+				fn(visit)
+			}
+		}
+	}
+	return true
+}
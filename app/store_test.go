@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newTestStore makes a live store of users users, locations locations and
+// visits visits spread over them, created through createEntity like POSTs.
+func newTestStore(tb testing.TB, users, locations, visits int) *Store {
+	s := NewStore(0, 0, 0)
+	live.Store(s)
+	for id := 1; id <= users; id++ {
+		gender := "m"
+		if id%2 == 0 {
+			gender = "f"
+		}
+		mustCreate(tb, s, 'u', fmt.Sprintf(`{"id":%d,"email":"u%d@x.ru","first_name":"F","last_name":"L","gender":"%s","birth_date":%d}`, id, id, gender, -id*10000000))
+	}
+	for id := 1; id <= locations; id++ {
+		mustCreate(tb, s, 'l', fmt.Sprintf(`{"id":%d,"place":"P%d","country":"C%d","city":"T%d","distance":%d}`, id, id%7, id%3, id%5, id*3))
+	}
+	for id := 1; id <= visits; id++ {
+		mustCreate(tb, s, 'v', fmt.Sprintf(`{"id":%d,"location":%d,"user":%d,"visited_at":%d,"mark":%d}`, id, id%locations+1, id%users+1, id*1000%97000, id%6))
+	}
+	return s
+}
+
+func mustCreate(tb testing.TB, s *Store, entity byte, body string) {
+	if err := createEntity(s, entity, []byte(body), false); err != nil {
+		tb.Fatalf("create %c %s: %v", entity, body, err)
+	}
+}
+
+// newRequest makes a GET request context for uri.
+func newRequest(uri string) *fasthttp.RequestCtx {
+	ctx := new(fasthttp.RequestCtx)
+	ctx.Request.SetRequestURI(uri)
+	return ctx
+}
+
+// serve runs a request through r and returns its context.
+func serve(r *Router, method, uri, body string) *fasthttp.RequestCtx {
+	ctx := newRequest(uri)
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetBodyString(body)
+	r.Serve(ctx)
+	return ctx
+}
+
+// checkVisitLists fails unless every visit sits exactly once in its user's
+// list and once in its location's bucket, each list in (visited_at, id)
+// order.
+func checkVisitLists(t *testing.T, s *Store) {
+	seen := make(map[*Visit]int)
+	ordered := func(l *visitList, owner string) {
+		var prev *Visit
+		for _, entry := range l.items {
+			if entry.visit == nil {
+				continue
+			}
+			if entry.at != entry.visit.VisitedAt {
+				t.Errorf("%s: visit %d filed at %d, visited at %d", owner, entry.visit.ID, entry.at, entry.visit.VisitedAt)
+			}
+			if prev != nil && (prev.VisitedAt > entry.visit.VisitedAt || prev.VisitedAt == entry.visit.VisitedAt && prev.ID > entry.visit.ID) {
+				t.Errorf("%s: visit %d before %d", owner, prev.ID, entry.visit.ID)
+			}
+			prev = entry.visit
+			seen[entry.visit]++
+		}
+	}
+	s.EachUser(func(user *User) {
+		ordered(&user.visits, fmt.Sprintf("user %d", user.ID))
+		user.visits.each(func(visit *Visit) {
+			if visit.userRef != user {
+				t.Errorf("visit %d in the list of user %d, belongs to %d", visit.ID, user.ID, visit.User)
+			}
+		})
+	})
+	s.EachLocation(func(location *Location) {
+		for i := range location.visits {
+			ordered(&location.visits[i], fmt.Sprintf("location %d bucket %d", location.ID, i))
+			location.visits[i].each(func(visit *Visit) {
+				if visit.locationRef != location || genderBucket(visit.userRef.Gender) != i {
+					t.Errorf("visit %d misfiled under location %d bucket %d", visit.ID, location.ID, i)
+				}
+			})
+		}
+	})
+	s.EachVisit(func(visit *Visit) {
+		if seen[visit] != 2 {
+			t.Errorf("visit %d is in %d lists, want 2", visit.ID, seen[visit])
+		}
+		delete(seen, visit)
+	})
+	for visit := range seen {
+		t.Errorf("visit %d is listed but not stored", visit.ID)
+	}
+}
+
+// checkSameStore fails unless got holds the same users, locations and
+// visits as want, with consistent visit lists.
+func checkSameStore(t *testing.T, got, want *Store) {
+	t.Helper()
+	if got.userCount != want.userCount || got.locationCount != want.locationCount || got.visitCount != want.visitCount {
+		t.Errorf("got %d users, %d locations, %d visits, want %d, %d, %d",
+			got.userCount, got.locationCount, got.visitCount, want.userCount, want.locationCount, want.visitCount)
+	}
+	want.EachUser(func(user *User) {
+		if other := got.User(user.ID); other == nil || userFields(other) != userFields(user) {
+			t.Errorf("user %d: got %+v, want %+v", user.ID, other, user)
+		}
+	})
+	want.EachLocation(func(location *Location) {
+		if other := got.Location(location.ID); other == nil || locationFields(other) != locationFields(location) {
+			t.Errorf("location %d: got %+v, want %+v", location.ID, other, location)
+		}
+	})
+	want.EachVisit(func(visit *Visit) {
+		if other := got.Visit(visit.ID); other == nil || visitFields(other) != visitFields(visit) {
+			t.Errorf("visit %d: got %+v, want %+v", visit.ID, other, visit)
+		}
+	})
+	checkVisitLists(t, got)
+}
+
+func userFields(user *User) string {
+	return fmt.Sprintf("%d %d %q %q %q %q", user.ID, user.BirthDate, user.Email, user.FirstName, user.LastName, user.Gender)
+}
+
+func locationFields(location *Location) string {
+	return fmt.Sprintf("%d %d %q %q %q", location.ID, location.Distance, location.Place, location.Country, location.City)
+}
+
+func visitFields(visit *Visit) string {
+	return fmt.Sprintf("%d %d %d %d %d", visit.ID, visit.Location, visit.User, visit.VisitedAt, visit.Mark)
+}
+
+// TestConcurrentAccess runs writers against readers and the snapshotter on
+// one store; run it with -race.
+func TestConcurrentAccess(t *testing.T) {
+	const users, locations, visits = 20, 10, 400
+	s := newTestStore(t, users, locations, visits)
+
+	var writers, readers sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 300; i++ {
+				id := visits + 1 + w*1000 + i
+				switch rnd.Intn(5) {
+				case 0:
+					createEntity(s, 'v', []byte(fmt.Sprintf(`{"id":%d,"location":%d,"user":%d,"visited_at":%d,"mark":%d}`,
+						id, rnd.Intn(locations)+1, rnd.Intn(users)+1, rnd.Intn(100000), rnd.Intn(6))), false)
+				case 1:
+					updateEntity(s, 'v', rnd.Intn(visits)+1, []byte(fmt.Sprintf(`{"visited_at":%d,"location":%d}`,
+						rnd.Intn(100000), rnd.Intn(locations)+1)))
+				case 2:
+					updateEntity(s, 'v', rnd.Intn(visits)+1, []byte(fmt.Sprintf(`{"user":%d,"mark":%d}`,
+						rnd.Intn(users)+1, rnd.Intn(6))))
+				case 3:
+					updateEntity(s, 'u', rnd.Intn(users)+1, []byte(`{"gender":"`+[]string{"m", "f"}[rnd.Intn(2)]+`"}`))
+				case 4:
+					deleteEntity(s, 'v', rnd.Intn(visits)+1, deleteReject)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			rnd := rand.New(rand.NewSource(int64(100 + r)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var ctx *fasthttp.RequestCtx
+				switch rnd.Intn(4) {
+				case 0:
+					ctx = newRequest("/users/1/visits?fromDate=1000&toDate=90000&toDistance=25")
+					Visits(ctx, []byte(fmt.Sprint(rnd.Intn(users)+1)))
+				case 1:
+					ctx = newRequest("/locations/1/avg?fromDate=1000&gender=f&fromAge=1")
+					Avg(ctx, []byte(fmt.Sprint(rnd.Intn(locations)+1)))
+				case 2:
+					ctx = newRequest("/visits/1")
+					EntityById(ctx, 'v', []byte(fmt.Sprint(rnd.Intn(visits)+1)))
+				case 3:
+					encodeSnapshot(s)
+					continue
+				}
+				if status := ctx.Response.StatusCode(); status != fasthttp.StatusOK && status != fasthttp.StatusNotFound {
+					t.Errorf("read answered %d", status)
+				}
+			}
+		}(r)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	checkVisitLists(t, s)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// compactMinTombstones keeps short lists from being rewritten on every
+// removal; above it a list is compacted once a quarter of it is tombstones.
+const compactMinTombstones = 8
+
+// visitEntry keeps the visited_at a visit was filed under next to it, so
+// sorted lists can be binary searched without chasing pointers and a
+// tombstone (nil visit) still sits at a valid position in the order.
+type visitEntry struct {
+	at    int
+	visit *Visit
+}
+
+// visitList is the set of visits hanging off a user or location. Removing a
+// visit only leaves a nil tombstone in its place, so a removal costs a
+// search rather than shifting the rest of the list down; tombstones are
+// compacted away in one pass once they make up a quarter of the list, which
+// spreads that cost over the removals that caused it. Callers hold the
+// store write lock for changes, and at least the read lock to iterate
+// items.
+//
+// Lists are ordered by (visited_at, id): insert and removeSorted keep them
+// that way, while add only appends and is followed by sort when bulk
+// loading.
+type visitList struct {
+	items      []visitEntry
+	tombstones int
+}
+
+// listSlots and listTombstones total len(items) and tombstones over every
+// visit list, so /metrics can report them without walking the store. Lists
+// being loaded for a reload count too until the reload fails or retires
+// the store they replace.
+var listSlots, listTombstones int64
+
+func (l *visitList) add(visit *Visit) {
+	l.items = append(l.items, visitEntry{visit.VisitedAt, visit})
+	atomic.AddInt64(&listSlots, 1)
+}
+
+// insert files visit at its (visited_at, id) position.
+func (l *visitList) insert(visit *Visit) {
+	i := l.after(visit.VisitedAt)
+	for i > 0 && l.items[i-1].at == visit.VisitedAt && (l.items[i-1].visit == nil || l.items[i-1].visit.ID > visit.ID) {
+		i--
+	}
+	l.items = append(l.items, visitEntry{})
+	copy(l.items[i+1:], l.items[i:])
+	l.items[i] = visitEntry{visit.VisitedAt, visit}
+	atomic.AddInt64(&listSlots, 1)
+}
+
+// removeSorted drops visit from an ordered list. visit.VisitedAt must still
+// be the value it was inserted with.
+func (l *visitList) removeSorted(visit *Visit) bool {
+	for i := l.before(visit.VisitedAt); i < len(l.items) && l.items[i].at == visit.VisitedAt; i++ {
+		if l.items[i].visit == visit {
+			l.bury(i)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *visitList) bury(i int) {
+	l.items[i].visit = nil
+	l.tombstones++
+	atomic.AddInt64(&listTombstones, 1)
+	if l.tombstones >= compactMinTombstones && l.tombstones*4 >= len(l.items) {
+		l.compact()
+	}
+}
+
+// after returns the index of the first entry visited strictly after at.
+func (l *visitList) after(at int) int {
+	return sort.Search(len(l.items), func(i int) bool {
+		return l.items[i].at > at
+	})
+}
+
+// before returns the index of the first entry visited at or after at, i.e.
+// the end of the entries visited strictly before it.
+func (l *visitList) before(at int) int {
+	return sort.Search(len(l.items), func(i int) bool {
+		return l.items[i].at >= at
+	})
+}
+
+// resume returns the index of the first entry ordered after the visit at
+// (at, id), whether or not that visit is still in the list.
+func (l *visitList) resume(at, id int) int {
+	i := l.before(at)
+	for i < len(l.items) && l.items[i].at == at && (l.items[i].visit == nil || l.items[i].visit.ID <= id) {
+		i++
+	}
+	return i
+}
+
+// resumeBefore returns the index just past the last entry ordered before the
+// visit at (at, id), for walking the list backwards from a cursor.
+func (l *visitList) resumeBefore(at, id int) int {
+	i := l.before(at)
+	for i < len(l.items) && l.items[i].at == at && (l.items[i].visit == nil || l.items[i].visit.ID < id) {
+		i++
+	}
+	return i
+}
+
+// sort orders a list built with add, for bulk loading.
+func (l *visitList) sort() {
+	l.compact()
+	sort.Slice(l.items, func(i, j int) bool {
+		a, b := l.items[i], l.items[j]
+		return a.at < b.at || a.at == b.at && a.visit.ID < b.visit.ID
+	})
+}
+
+// compact drops tombstones, keeping the remaining visits in order.
+func (l *visitList) compact() {
+	n := 0
+	for _, entry := range l.items {
+		if entry.visit != nil {
+			l.items[n] = entry
+			n++
+		}
+	}
+	for i := n; i < len(l.items); i++ {
+		l.items[i] = visitEntry{}
+	}
+	atomic.AddInt64(&listSlots, int64(n-len(l.items)))
+	atomic.AddInt64(&listTombstones, -int64(l.tombstones))
+	l.items = l.items[:n]
+	l.tombstones = 0
+}
+
+// forget takes a list that is being dropped along with its owner out of
+// the totals.
+func (l *visitList) forget() {
+	atomic.AddInt64(&listSlots, -int64(len(l.items)))
+	atomic.AddInt64(&listTombstones, -int64(l.tombstones))
+}
+
+// each calls fn for every live visit in order.
+func (l *visitList) each(fn func(*Visit)) {
+	for _, entry := range l.items {
+		if entry.visit != nil {
+			fn(entry.visit)
+		}
+	}
+}
+
+func (l *visitList) len() int {
+	return len(l.items) - l.tombstones
+}
+
+const (
+	genderFemale = iota
+	genderMale
+	genderOther
+	genderBuckets
+)
+
+func genderBucket(gender string) int {
+	switch gender {
+	case "f":
+		return genderFemale
+	case "m":
+		return genderMale
+	}
+	return genderOther
+}
+
+// locationVisits is a location's visits split by the visitor's gender, each
+// bucket an ordered visitList, so Avg can answer gender and date filters
+// with range lookups. A visit's bucket follows visit.userRef.Gender; callers
+// must take a visit out before changing its user, its user's gender or its
+// visited_at, and put it back afterwards.
+type locationVisits [genderBuckets]visitList
+
+func (v *locationVisits) add(visit *Visit) {
+	v[genderBucket(visit.userRef.Gender)].add(visit)
+}
+
+func (v *locationVisits) insert(visit *Visit) {
+	v[genderBucket(visit.userRef.Gender)].insert(visit)
+}
+
+func (v *locationVisits) removeSorted(visit *Visit) bool {
+	return v[genderBucket(visit.userRef.Gender)].removeSorted(visit)
+}
+
+func (v *locationVisits) sort() {
+	for i := range v {
+		v[i].sort()
+	}
+}
+
+func (v *locationVisits) forget() {
+	for i := range v {
+		v[i].forget()
+	}
+}
+
+func (v *locationVisits) each(fn func(*Visit)) {
+	for i := range v {
+		v[i].each(fn)
+	}
+}
+
+func (v *locationVisits) len() int {
+	n := 0
+	for i := range v {
+		n += v[i].len()
+	}
+	return n
+}
+
+// forgetVisitLists takes every list of s, a store being discarded, out of
+// the totals.
+func (s *Store) forgetVisitLists() {
+	s.EachUser(func(user *User) {
+		user.visits.forget()
+	})
+	s.EachLocation(func(location *Location) {
+		location.visits.forget()
+	})
+}
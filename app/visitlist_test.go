@@ -0,0 +1,277 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// walkListTotals sums slots and tombstones over the lists of s the slow
+// way, to check the running totals against.
+func walkListTotals(s *Store) (slots, tombstones int64) {
+	count := func(l *visitList) {
+		slots += int64(len(l.items))
+		tombstones += int64(l.tombstones)
+	}
+	s.EachUser(func(user *User) {
+		count(&user.visits)
+	})
+	s.EachLocation(func(location *Location) {
+		for i := range location.visits {
+			count(&location.visits[i])
+		}
+	})
+	return slots, tombstones
+}
+
+func TestListTotals(t *testing.T) {
+	old := newTestStore(t, 5, 5, 50)
+	baseSlots, baseTombstones := atomic.LoadInt64(&listSlots), atomic.LoadInt64(&listTombstones)
+	s := newTestStore(t, 20, 10, 400)
+	check := func(when string) {
+		t.Helper()
+		slots, tombstones := walkListTotals(s)
+		if got := atomic.LoadInt64(&listSlots) - baseSlots; got != slots {
+			t.Errorf("%s: %d slots counted, %d in the lists", when, got, slots)
+		}
+		if got := atomic.LoadInt64(&listTombstones) - baseTombstones; got != tombstones {
+			t.Errorf("%s: %d tombstones counted, %d in the lists", when, got, tombstones)
+		}
+	}
+	check("created")
+
+	for id := 1; id <= 200; id += 3 {
+		deleteEntity(s, 'v', id, deleteReject)
+	}
+	for id := 2; id <= 200; id += 3 {
+		updateEntity(s, 'v', id, []byte(`{"visited_at":50,"user":4}`))
+	}
+	updateEntity(s, 'u', 3, []byte(`{"gender":"m"}`))
+	check("updated")
+
+	deleteEntity(s, 'u', 4, deleteCascade)
+	deleteEntity(s, 'l', 2, deleteCascade)
+	createEntity(s, 'u', []byte(`{"id":5,"email":"x@y.ru","first_name":"X","last_name":"Y","gender":"f","birth_date":0}`), true)
+	check("cascaded")
+
+	// retiring a store takes its lists out of the totals
+	live.Store(old)
+	oldSlots, oldTombstones := walkListTotals(old)
+	beforeSlots, beforeTombstones := atomic.LoadInt64(&listSlots), atomic.LoadInt64(&listTombstones)
+	replaceStore(s, "")
+	if got := beforeSlots - atomic.LoadInt64(&listSlots); got != oldSlots {
+		t.Errorf("retiring a store with %d slots took %d out", oldSlots, got)
+	}
+	if got := beforeTombstones - atomic.LoadInt64(&listTombstones); got != oldTombstones {
+		t.Errorf("retiring a store with %d tombstones took %d out", oldTombstones, got)
+	}
+}
+
+// listIDs returns the IDs of the live visits in l, in order.
+func listIDs(l *visitList) []int {
+	ids := make([]int, 0)
+	l.each(func(visit *Visit) {
+		ids = append(ids, visit.ID)
+	})
+	return ids
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestVisitListTombstoneOrder(t *testing.T) {
+	visits := make(map[int]*Visit)
+	visit := func(id, at int) *Visit {
+		visits[id] = &Visit{ID: id, VisitedAt: at}
+		return visits[id]
+	}
+	var l visitList
+	for _, v := range []*Visit{visit(5, 10), visit(3, 10), visit(7, 10), visit(1, 9), visit(9, 11), visit(8, 10)} {
+		l.insert(v)
+	}
+	if ids, want := listIDs(&l), []int{1, 3, 5, 7, 8, 9}; !sameIDs(ids, want) {
+		t.Fatalf("inserted: %v, want %v", ids, want)
+	}
+
+	// tombstones keep their visited_at, so lookups still land on the run
+	// of entries at 10 with the dead ones inside it
+	if !l.removeSorted(visits[5]) || !l.removeSorted(visits[7]) {
+		t.Fatal("removeSorted missed a listed visit")
+	}
+	if l.removeSorted(visits[5]) {
+		t.Error("removeSorted found a visit twice")
+	}
+	if l.removeSorted(&Visit{ID: 4, VisitedAt: 10}) {
+		t.Error("removeSorted found an unlisted visit")
+	}
+	if got := l.before(10); got != 1 {
+		t.Errorf("before(10) = %d, want 1", got)
+	}
+	if got := l.after(10); got != 5 {
+		t.Errorf("after(10) = %d, want 5", got)
+	}
+	if got := l.after(9); got != 1 {
+		t.Errorf("after(9) = %d, want 1", got)
+	}
+	if got := l.before(11); got != 5 {
+		t.Errorf("before(11) = %d, want 5", got)
+	}
+
+	// new visits at 10 go in between the live ones whichever side of a
+	// tombstone that is
+	l.insert(visit(6, 10))
+	l.insert(visit(4, 10))
+	l.insert(visit(2, 10))
+	if ids, want := listIDs(&l), []int{1, 2, 3, 4, 6, 8, 9}; !sameIDs(ids, want) {
+		t.Errorf("after reinserting: %v, want %v", ids, want)
+	}
+	if !l.removeSorted(visits[8]) || !l.removeSorted(visits[3]) {
+		t.Fatal("removeSorted missed a visit next to a tombstone")
+	}
+	if ids, want := listIDs(&l), []int{1, 2, 4, 6, 9}; !sameIDs(ids, want) {
+		t.Errorf("after removing: %v, want %v", ids, want)
+	}
+	for i := 1; i < len(l.items); i++ {
+		if l.items[i-1].at > l.items[i].at {
+			t.Fatalf("entry %d at %d before entry at %d", i-1, l.items[i-1].at, l.items[i].at)
+		}
+	}
+
+	// cursors resume past the named visit even when it is a tombstone
+	if i := l.resume(10, 3); l.items[i].visit != visits[4] {
+		t.Errorf("resume(10, 3) lands on %v, want visit 4", l.items[i].visit)
+	}
+	if i := l.resumeBefore(10, 6); l.items[i-1].visit != visits[4] {
+		t.Errorf("resumeBefore(10, 6) ends after %v, want visit 4", l.items[i-1].visit)
+	}
+
+	// compaction drops the tombstones and keeps the order
+	for _, id := range []int{2, 4, 6} {
+		l.removeSorted(visits[id])
+	}
+	l.compact()
+	if ids, want := listIDs(&l), []int{1, 9}; !sameIDs(ids, want) || len(l.items) != 2 || l.tombstones != 0 {
+		t.Errorf("compacted: %v in %d slots with %d tombstones, want %v", ids, len(l.items), l.tombstones, want)
+	}
+}
+
+// BenchmarkVisits serves a filtered /users/{id}/visits from the ordered
+// list, against the scan of an unordered list and sort.Slice it replaced.
+func BenchmarkVisits(b *testing.B) {
+	s := newTestStore(b, 1, 50, 5000)
+	ctx := newRequest("/users/1/visits?fromDate=20000&toDate=80000&toDistance=100")
+	id := []byte("1")
+	b.Run("ordered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ctx.Response.Reset()
+			Visits(ctx, id)
+		}
+	})
+	// the visits in the order they were created, as the lists used to be
+	unordered := make([]*Visit, 0, 5000)
+	s.EachVisit(func(visit *Visit) {
+		unordered = append(unordered, visit)
+	})
+	b.Run("scan+sort", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ctx.Response.Reset()
+			scanVisits(ctx, unordered)
+		}
+	})
+}
+
+// scanVisits is the Visits handler as it was before the lists were
+// ordered: every visit is checked against every filter and the matches are
+// sorted afterwards.
+func scanVisits(ctx *fasthttp.RequestCtx, visits []*Visit) []byte {
+	filters := make([]visitPredicate, 0)
+	args := ctx.QueryArgs()
+	if fromDate, err := args.GetUint("fromDate"); err == nil {
+		filters = append(filters, func(x *Visit) bool {
+			return x.VisitedAt > fromDate
+		})
+	}
+	if toDate, err := args.GetUint("toDate"); err == nil {
+		filters = append(filters, func(x *Visit) bool {
+			return x.VisitedAt < toDate
+		})
+	}
+	if toDistance, err := args.GetUint("toDistance"); err == nil {
+		filters = append(filters, func(x *Visit) bool {
+			return x.locationRef.Distance < toDistance
+		})
+	}
+	resultVisits := make([]VisitResult, 0)
+	for _, visit := range visits {
+		satisfy := true
+		for _, fn := range filters {
+			if !fn(visit) {
+				satisfy = false
+				break
+			}
+		}
+		if satisfy {
+			resultVisits = append(resultVisits, VisitResult{
+				Place:     visit.locationRef.Place,
+				Mark:      visit.Mark,
+				VisitedAt: visit.VisitedAt,
+			})
+		}
+	}
+	sort.Slice(resultVisits, func(i, j int) bool {
+		return resultVisits[i].VisitedAt < resultVisits[j].VisitedAt
+	})
+	bytes, _ := VisitsResult{Visits: resultVisits}.MarshalJSON()
+	return bytes
+}
+
+func TestVisitListResume(t *testing.T) {
+	visits := make(map[int]*Visit)
+	var l visitList
+	for id, at := range map[int]int{1: 10, 2: 20, 3: 20, 4: 20, 5: 30, 6: 30} {
+		visits[id] = &Visit{ID: id, VisitedAt: at}
+		l.insert(visits[id])
+	}
+	// tombstones inside both ties, one where a cursor may point
+	l.removeSorted(visits[3])
+	l.removeSorted(visits[6])
+
+	// resume splits the live visits into those ordered at or before the
+	// cursor and those after it, resumeBefore into those strictly before
+	// it and the rest
+	ordered := func(visit *Visit, at, id int) int {
+		if visit.VisitedAt != at {
+			return visit.VisitedAt - at
+		}
+		return visit.ID - id
+	}
+	for _, cursor := range [][2]int{{10, 1}, {20, 2}, {20, 3}, {20, 4}, {30, 5}, {30, 6}, {20, 0}, {20, 99}, {15, 7}, {5, 1}, {40, 1}} {
+		at, id := cursor[0], cursor[1]
+		resume, resumeBefore := l.resume(at, id), l.resumeBefore(at, id)
+		for i, entry := range l.items {
+			if entry.visit == nil {
+				continue
+			}
+			cmp := ordered(entry.visit, at, id)
+			if (i < resume) != (cmp <= 0) {
+				t.Errorf("resume(%d, %d) = %d puts visit %d on the wrong side", at, id, resume, entry.visit.ID)
+			}
+			if (i < resumeBefore) != (cmp < 0) {
+				t.Errorf("resumeBefore(%d, %d) = %d puts visit %d on the wrong side", at, id, resumeBefore, entry.visit.ID)
+			}
+		}
+	}
+}
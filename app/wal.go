@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	opCreate = 'c'
+	opUpsert = 'p'
+	opUpdate = 'u'
+	opDelete = 'd'
+	// opReload marks where a reload swapped in the dataset at the path in
+	// its body; the records after it apply to that dataset
+	opReload = 'r'
+	// opImport is a whole /import batch, its entity byte opCreate or
+	// opUpsert
+	opImport = 'i'
+)
+
+const (
+	syncAlways   = "always"
+	syncInterval = "interval"
+	syncNever    = "never"
+)
+
+// walHeaderSize is the frame header: payload length and its CRC32. The
+// payload itself is lsn(8) op(1) entity(1) id(4) followed by the request body.
+const walHeaderSize = 8
+const walPayloadHeaderSize = 14
+
+var errWALCorrupt = errors.New("corrupt record")
+
+// WAL is an append-only log of applied mutations. Records are written with a
+// single write call each so a crash can only leave a torn last record, which
+// replay detects by its checksum and truncates.
+type WAL struct {
+	mu     sync.Mutex
+	file   *os.File
+	policy string
+	lsn    uint64
+	size   int64
+	buf    []byte
+}
+
+type walRecord struct {
+	lsn    uint64
+	op     byte
+	entity byte
+	id     int
+	body   []byte
+}
+
+// OpenWAL replays the records in the log at path that come after lsn from
+// through apply and opens it for appending. A torn or corrupt tail is
+// truncated away.
+func OpenWAL(path, policy string, interval time.Duration, from uint64, apply func(walRecord)) (*WAL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	w := &WAL{policy: policy, lsn: from}
+	offset, count := 0, 0
+	for offset < len(data) {
+		record, n, err := decodeWALRecord(data[offset:])
+		if err != nil {
+			log.Printf("wal: %v at offset %d, truncating %d bytes", err, offset, len(data)-offset)
+			break
+		}
+		offset += n
+		if record.lsn <= from {
+			continue
+		}
+		apply(record)
+		w.lsn = record.lsn
+		count++
+	}
+	log.Printf("wal: replayed %d records from %s", count, path)
+
+	w.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.file.Truncate(int64(offset)); err != nil {
+		return nil, err
+	}
+	if _, err := w.file.Seek(int64(offset), 0); err != nil {
+		return nil, err
+	}
+	w.size = int64(offset)
+
+	if policy == syncInterval {
+		go w.syncLoop(interval)
+	}
+	return w, nil
+}
+
+func decodeWALRecord(data []byte) (walRecord, int, error) {
+	var record walRecord
+	if len(data) < walHeaderSize {
+		return record, 0, errWALCorrupt
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	sum := binary.LittleEndian.Uint32(data[4:])
+	if size < walPayloadHeaderSize || len(data) < walHeaderSize+size {
+		return record, 0, errWALCorrupt
+	}
+	payload := data[walHeaderSize : walHeaderSize+size]
+	if crc32.ChecksumIEEE(payload) != sum {
+		return record, 0, errWALCorrupt
+	}
+	record.lsn = binary.LittleEndian.Uint64(payload)
+	record.op = payload[8]
+	record.entity = payload[9]
+	record.id = int(binary.LittleEndian.Uint32(payload[10:]))
+	record.body = payload[walPayloadHeaderSize:]
+	return record, walHeaderSize + size, nil
+}
+
+// Append writes a mutation to the log, syncing it to disk first if the
+// policy is "always". A nil WAL discards the record.
+func (w *WAL) Append(op, entity byte, id int, body []byte) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	size := walPayloadHeaderSize + len(body)
+	buf := w.buf[:0]
+	buf = append(buf, make([]byte, walHeaderSize+walPayloadHeaderSize)...)
+	binary.LittleEndian.PutUint32(buf, uint32(size))
+	binary.LittleEndian.PutUint64(buf[walHeaderSize:], w.lsn+1)
+	buf[walHeaderSize+8] = op
+	buf[walHeaderSize+9] = entity
+	binary.LittleEndian.PutUint32(buf[walHeaderSize+10:], uint32(id))
+	buf = append(buf, body...)
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[walHeaderSize:]))
+	w.buf = buf
+
+	if _, err := w.file.Write(buf); err != nil {
+		// drop whatever part of the record made it so later appends
+		// are not hidden behind a torn frame on replay
+		w.file.Truncate(w.size)
+		w.file.Seek(w.size, 0)
+		return err
+	}
+	w.size += int64(len(buf))
+	w.lsn++
+	if w.policy == syncAlways {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// LSN returns the sequence number of the last appended record.
+func (w *WAL) LSN() uint64 {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lsn
+}
+
+// Reset empties the log once a snapshot covering everything up to lsn is
+// durable. It leaves the log alone if records were appended after lsn.
+// Sequence numbers keep counting from where they were.
+func (w *WAL) Reset(lsn uint64) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lsn != lsn {
+		return nil
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, 0); err != nil {
+		return err
+	}
+	w.size = 0
+	return w.file.Sync()
+}
+
+func (w *WAL) syncLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := w.file.Sync(); err != nil {
+			log.Println("wal:", err)
+		}
+	}
+}
+
+func replayWAL(record walRecord) {
+	var err *Error
+	switch record.op {
+	case opReload:
+		// the records that follow only make sense against the reloaded
+		// dataset, so there is no carrying on without it
+		if err := replayReload(string(record.body)); err != nil {
+			log.Fatalf("wal: record %d reloads %s: %v", record.lsn, record.body, err)
+		}
+	case opCreate:
+		err = createEntity(currentStore(), record.entity, record.body, false)
+	case opUpsert:
+		err = createEntity(currentStore(), record.entity, record.body, true)
+	case opUpdate:
+		err = updateEntity(currentStore(), record.entity, record.id, record.body)
+	case opDelete:
+		err = deleteEntity(currentStore(), record.entity, record.id, string(record.body))
+	case opImport:
+		_, err = importEntities(currentStore(), record.body, record.entity == opUpsert)
+	}
+	if err != nil {
+		log.Printf("wal: record %d (%c %c %d) failed: %v", record.lsn, record.op, record.entity, record.id, err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestWAL replays the log at path onto the live store and makes it the
+// WAL mutations are logged to until the test ends.
+func openTestWAL(t *testing.T, path string, from uint64) *WAL {
+	t.Helper()
+	w, err := OpenWAL(path, syncNever, 0, from, replayWAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal = w
+	t.Cleanup(func() {
+		w.file.Close()
+		wal = nil
+	})
+	return w
+}
+
+// closeTestWAL stops logging to w, as a crash or shutdown would.
+func closeTestWAL(w *WAL) {
+	w.file.Close()
+	wal = nil
+}
+
+// TestWALReplay logs every kind of mutation, then replays the log onto the
+// dataset it started from and expects the store it was written against.
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s := newTestStore(t, 4, 3, 12)
+	w := openTestWAL(t, path, 0)
+
+	mutations := []struct {
+		name string
+		run  func() *Error
+	}{
+		{"create user", func() *Error {
+			return createEntity(s, 'u', []byte(`{"id":5,"email":"new@x.ru","first_name":"N","last_name":"U","gender":"f","birth_date":0}`), false)
+		}},
+		{"create location", func() *Error {
+			return createEntity(s, 'l', []byte(`{"id":4,"place":"Pier","country":"Chile","city":"Arica","distance":9}`), false)
+		}},
+		{"create visit", func() *Error {
+			return createEntity(s, 'v', []byte(`{"id":13,"location":4,"user":5,"visited_at":500,"mark":2}`), false)
+		}},
+		{"upsert user", func() *Error {
+			return createEntity(s, 'u', []byte(`{"id":2,"email":"up@x.ru","first_name":"U","last_name":"P","gender":"m","birth_date":7}`), true)
+		}},
+		{"upsert location", func() *Error {
+			return createEntity(s, 'l', []byte(`{"id":1,"place":"Dock","country":"Peru","city":"Lima","distance":1}`), true)
+		}},
+		{"upsert visit", func() *Error {
+			return createEntity(s, 'v', []byte(`{"id":3,"location":2,"user":5,"visited_at":42,"mark":0}`), true)
+		}},
+		{"update user", func() *Error {
+			return updateEntity(s, 'u', 3, []byte(`{"gender":"f","email":"moved@x.ru"}`))
+		}},
+		{"update location", func() *Error {
+			return updateEntity(s, 'l', 3, []byte(`{"distance":77}`))
+		}},
+		{"update visit", func() *Error {
+			return updateEntity(s, 'v', 6, []byte(`{"visited_at":1,"location":4,"mark":5}`))
+		}},
+		{"delete visit", func() *Error {
+			return deleteEntity(s, 'v', 7, deleteReject)
+		}},
+		{"cascade user", func() *Error {
+			return deleteEntity(s, 'u', 1, deleteCascade)
+		}},
+		{"cascade location", func() *Error {
+			return deleteEntity(s, 'l', 2, deleteCascade)
+		}},
+		{"reject empty user", func() *Error {
+			if err := createEntity(s, 'u', []byte(`{"id":9,"email":"e@x.ru","first_name":"E","last_name":"M","gender":"m","birth_date":0}`), false); err != nil {
+				return err
+			}
+			return deleteEntity(s, 'u', 9, deleteReject)
+		}},
+	}
+	for _, m := range mutations {
+		if err := m.run(); err != nil {
+			t.Fatalf("%s: %v", m.name, err)
+		}
+	}
+	// a delete refused for its visits is never logged
+	if err := deleteEntity(s, 'u', 5, deleteReject); err != errHasVisits {
+		t.Fatalf("delete user 5: got %v, want %v", err, errHasVisits)
+	}
+	lsn := w.LSN()
+	closeTestWAL(w)
+
+	replayed := newTestStore(t, 4, 3, 12)
+	w = openTestWAL(t, path, 0)
+	if w.LSN() != lsn {
+		t.Errorf("replayed up to lsn %d, want %d", w.LSN(), lsn)
+	}
+	checkSameStore(t, replayed, s)
+}
+
+// TestWALTornTail cuts the last record short, as a crash mid-write would,
+// and checks replay drops it and later appends survive the next restart.
+func TestWALTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s := newTestStore(t, 2, 2, 4)
+	w := openTestWAL(t, path, 0)
+	mustCreate(t, s, 'u', `{"id":3,"email":"a@x.ru","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	mustCreate(t, s, 'u', `{"id":4,"email":"c@x.ru","first_name":"C","last_name":"D","gender":"f","birth_date":0}`)
+	closeTestWAL(w)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestStore(t, 2, 2, 4)
+	w = openTestWAL(t, path, 0)
+	if s.User(3) == nil || s.User(4) != nil {
+		t.Fatalf("after a torn tail: user 3 %v, user 4 %v; want only user 3", s.User(3) != nil, s.User(4) != nil)
+	}
+	if w.LSN() != 1 {
+		t.Errorf("lsn %d after replaying one record, want 1", w.LSN())
+	}
+	mustCreate(t, s, 'u', `{"id":5,"email":"e@x.ru","first_name":"E","last_name":"F","gender":"f","birth_date":0}`)
+	closeTestWAL(w)
+
+	replayed := newTestStore(t, 2, 2, 4)
+	openTestWAL(t, path, 0)
+	checkSameStore(t, replayed, s)
+}
+
+// TestWALSkipsSnapshotRecords replays a log from the lsn of a snapshot and
+// expects only the records after it to be applied.
+func TestWALSkipsSnapshotRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s := newTestStore(t, 2, 2, 4)
+	w := openTestWAL(t, path, 0)
+	mustCreate(t, s, 'u', `{"id":3,"email":"a@x.ru","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	from := w.LSN()
+	mustCreate(t, s, 'u', `{"id":4,"email":"c@x.ru","first_name":"C","last_name":"D","gender":"f","birth_date":0}`)
+	closeTestWAL(w)
+
+	// the store is left without user 3 to show its record is skipped
+	replayed := newTestStore(t, 2, 2, 4)
+	w = openTestWAL(t, path, from)
+	if replayed.User(3) != nil {
+		t.Error("record at the snapshot lsn was replayed")
+	}
+	if replayed.User(4) == nil {
+		t.Error("record after the snapshot lsn was not replayed")
+	}
+	if w.LSN() != from+1 {
+		t.Errorf("lsn %d, want %d", w.LSN(), from+1)
+	}
+}